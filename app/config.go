@@ -1,16 +1,34 @@
 package app
 
-import "context"
+import (
+	"context"
+	"github.com/dnsge/twitch-mobile-emotes/emotes"
+	"time"
+)
 
 type ServerConfig struct {
-	Address        string
-	Debug          bool
-	WebsocketHost  string
-	EmoticonHost   string
-	IncludeGifs    bool
-	CachePath      string
-	Purge          bool
-	RedisConn      string
-	RedisNamespace string
-	Context        context.Context
+	Address            string
+	Debug              bool
+	WebsocketHost      string
+	EmoticonHost       string
+	IncludeGifs        bool
+	MaxEmoteTiles      int
+	CacheBackend       string
+	CachePath          string
+	CacheMemoryBytes   int64
+	CacheMaxBytes      int64
+	CacheTTL           time.Duration
+	CacheEvictInterval time.Duration
+	Purge              bool
+	RedisConn          string
+	RedisNamespace     string
+	Providers          *emotes.ProviderConfig
+	Fetcher            emotes.FetcherOptions
+	SnapshotPath       string
+	SnapshotRedis      bool
+	SnapshotInterval   time.Duration
+	SharedCache        bool
+	LiveUpdates        bool
+	AnnounceChanges    bool
+	Context            context.Context
 }
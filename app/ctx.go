@@ -7,7 +7,9 @@ import (
 
 type Context struct {
 	EmoteStore         *emotes.EmoteStore
-	ImageCache         *emotes.ImageFileCache
+	ImageCache         emotes.ImageCache
 	Config             *ServerConfig
 	SettingsRepository storage.SettingsRepository
+	// Nil if live emote updates are disabled
+	LiveUpdates *emotes.LiveUpdates
 }
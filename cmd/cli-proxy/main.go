@@ -64,9 +64,9 @@ func main() {
 		log.Println("Connected to Redis")
 	}
 
-	store := emotes.NewEmoteStore()
-	if err := store.Init(); err != nil {
-		log.Fatalln(err)
+	store := emotes.NewEmoteStore(emotes.DefaultProviderConfig(), emotes.NewHTTPFetcher(nil, emotes.DefaultFetcherOptions()), ctx)
+	if err := store.Init(ctx); err != nil {
+		log.Printf("Warning: %v\n", err)
 	}
 
 	appCtx := &app.Context{
@@ -34,29 +34,74 @@ func main() {
 	wsHost := flag.String("ws-host", "irc-ws.chat.twitch.tv", "Host header to expect from Websocket IRC requests")
 	emHost := flag.String("emoticon-host", "static-cdn.jtvnw.net", "Host header to expect from Emoticon requests")
 	excludeGifs := flag.Bool("no-gifs", false, "Disable showing gif emotes")
+	maxTiles := flag.Int("max-tiles", 4, "Maximum number of tiles wide emotes are split into (1 to disable splitting)")
 	cachePath := flag.String("cache", "", "Path to cache files (leave empty to disable)")
+	cacheBackend := flag.String("cache-backend", "file", "Image cache backend (file, memory or redis)")
+	cacheMaxBytes := flag.Int64("cache-max-bytes", 0, "Maximum size of the file image cache in bytes (0 for unlimited)")
+	cacheTTL := flag.Duration("cache-ttl", time.Hour*48, "Time after which cached images are removed")
+	cacheEvictInterval := flag.Duration("cache-evict-interval", time.Minute*10, "Interval between file image cache eviction passes")
+	cacheMemoryBytes := flag.Int64("cache-memory-bytes", 256<<20, "Maximum size of the memory image cache in bytes")
 	purge := flag.Bool("purge", false, "Purge cache on startup")
 	idealGifsFile := flag.String("ideal-gifs", "", "Path to ideal gif frames file (leave empty to disable)")
 	redisConn := flag.String("redis-url", "", "Redis connection string")
 	redisNamespace := flag.String("redis-namespace", "tme", "Redis key namespace")
+	snapshotPath := flag.String("snapshot", "", "Path to emote metadata snapshot file (leave empty to disable)")
+	snapshotRedis := flag.Bool("snapshot-redis", false, "Store emote metadata snapshots in Redis instead of a file")
+	sharedCache := flag.Bool("shared-cache", false, "Share emote metadata with other replicas through Redis")
+	liveUpdates := flag.Bool("live-updates", false, "Apply BTTV and 7TV emote changes to channels with active sessions as they happen")
+	announceChanges := flag.Bool("announce-emote-changes", false, "Announce live emote changes in chat")
+	snapshotInterval := flag.Duration("snapshot-interval", time.Minute*5, "Interval between emote metadata snapshots")
+
+	providers := emotes.DefaultProviderConfig()
+	flag.StringVar(&providers.Bttv.APIBase, "bttv-api", providers.Bttv.APIBase, "BTTV API base URL")
+	flag.StringVar(&providers.Bttv.CDNBase, "bttv-cdn", "", "BTTV emote CDN base URL (leave empty for default)")
+	flag.StringVar(&providers.Bttv.Events, "bttv-events", providers.Bttv.Events, "BTTV live update websocket URL (leave empty to disable)")
+	flag.StringVar(&providers.Ffz.APIBase, "ffz-api", providers.Ffz.APIBase, "FFZ API base URL")
+	flag.StringVar(&providers.Ffz.CDNBase, "ffz-cdn", "", "FFZ emote CDN base URL (leave empty for default)")
+	flag.StringVar(&providers.SevenTV.APIBase, "7tv-api", providers.SevenTV.APIBase, "7TV API base URL")
+	flag.StringVar(&providers.SevenTV.CDNBase, "7tv-cdn", "", "7TV emote CDN base URL (leave empty for default)")
+	flag.StringVar(&providers.SevenTV.Events, "7tv-events", providers.SevenTV.Events, "7TV EventAPI websocket URL (leave empty to disable)")
+
+	fetcher := emotes.DefaultFetcherOptions()
+	flag.DurationVar(&fetcher.Timeout, "fetch-timeout", fetcher.Timeout, "Timeout for a single provider/CDN request attempt")
+	flag.IntVar(&fetcher.MaxRetries, "fetch-retries", fetcher.MaxRetries, "Number of retries for failed provider/CDN requests")
+	flag.IntVar(&fetcher.MaxPerHost, "fetch-host-limit", fetcher.MaxPerHost, "Maximum concurrent requests per provider/CDN host (0 for unlimited)")
 	flag.Parse()
 
+	if *maxTiles < 1 || *maxTiles > emotes.MaxTileCount {
+		log.Fatalf("-max-tiles must be between 1 and %d\n", emotes.MaxTileCount)
+	}
+
 	if *idealGifsFile != "" {
 		emotes.InitIdealGifFrames(*idealGifsFile)
 	}
 
 	ctx := signalInterrupterContext()
 	server := tme.MakeServer(&app.ServerConfig{
-		Address:        *addr,
-		Debug:          *debug,
-		WebsocketHost:  *wsHost,
-		EmoticonHost:   *emHost,
-		IncludeGifs:    !*excludeGifs,
-		CachePath:      *cachePath,
-		Purge:          *purge,
-		RedisConn:      *redisConn,
-		RedisNamespace: *redisNamespace,
-		Context:        ctx,
+		Address:            *addr,
+		Debug:              *debug,
+		WebsocketHost:      *wsHost,
+		EmoticonHost:       *emHost,
+		IncludeGifs:        !*excludeGifs,
+		MaxEmoteTiles:      *maxTiles,
+		CacheBackend:       *cacheBackend,
+		CachePath:          *cachePath,
+		CacheMemoryBytes:   *cacheMemoryBytes,
+		CacheMaxBytes:      *cacheMaxBytes,
+		CacheTTL:           *cacheTTL,
+		CacheEvictInterval: *cacheEvictInterval,
+		Purge:              *purge,
+		RedisConn:          *redisConn,
+		RedisNamespace:     *redisNamespace,
+		Providers:          providers,
+		Fetcher:            fetcher,
+		SnapshotPath:       *snapshotPath,
+		SnapshotRedis:      *snapshotRedis,
+		SnapshotInterval:   *snapshotInterval,
+		SharedCache:        *sharedCache,
+		LiveUpdates:        *liveUpdates,
+		AnnounceChanges:    *announceChanges,
+		Context:            ctx,
 	})
 
 	<-ctx.Done()
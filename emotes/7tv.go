@@ -1,24 +1,68 @@
 package emotes
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 )
 
 const (
-	sevenTVGlobalEmotesEndpoint   = "https://api.7tv.app/v2/emotes/global"
-	sevenTVChannelEmotesEndpoint  = "https://api.7tv.app/v2/users/%s/emotes"
-	sevenTVSpecificEmotesEndpoint = "https://api.7tv.app/v2/emotes/%s"
+	sevenTVDefaultAPIBase = "https://7tv.io/v3"
+
+	sevenTVGlobalEmotesEndpoint   = "%s/emote-sets/global"
+	sevenTVChannelEmotesEndpoint  = "%s/users/twitch/%s"
+	sevenTVSpecificEmotesEndpoint = "%s/emotes/%s"
+
+	// Flag of an emote in a set that is zero-width in that set only
+	sevenTVActiveZeroWidthFlag = 1 << 0
+	// Flag of an emote that is zero-width wherever it is used
+	sevenTVZeroWidthFlag = 1 << 8
 )
 
+// sevenTVFormats are the image formats 7TV serves, most preferred first.
+var sevenTVFormats = []string{"WEBP", "PNG", "GIF", "AVIF"}
+
+// SevenTVEmote is an emote in a 7TV emote set.
 type SevenTVEmote struct {
+	ID string `json:"id"`
+	// Name of the emote in its set, which may be an alias of its real name
+	Name  string            `json:"name"`
+	Flags int               `json:"flags"`
+	Data  *SevenTVEmoteData `json:"data"`
+
+	cdnBase string
+}
+
+// SevenTVEmoteData describes an emote independently of any emote set.
+type SevenTVEmoteData struct {
 	ID       string      `json:"id"`
 	Name     string      `json:"name"`
-	MimeType string      `json:"mime"`
-	URLs     [][2]string `json:"urls"`
+	Flags    int         `json:"flags"`
+	Animated bool        `json:"animated"`
+	Host     SevenTVHost `json:"host"`
+}
+
+// SevenTVHost lists the image files of an emote, found under URL.
+type SevenTVHost struct {
+	URL   string        `json:"url"`
+	Files []SevenTVFile `json:"files"`
+}
+
+type SevenTVFile struct {
+	Name       string `json:"name"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	FrameCount int    `json:"frame_count"`
+	Format     string `json:"format"`
+}
+
+type SevenTVUserConnection struct {
+	EmoteSet *SevenTVEmoteSet `json:"emote_set"`
+}
 
-	Widths  []int `json:"width"`
-	Heights []int `json:"height"`
+type SevenTVEmoteSet struct {
+	ID     string          `json:"id"`
+	Emotes []*SevenTVEmote `json:"emotes"`
 }
 
 func (s *SevenTVEmote) EmoteID() string {
@@ -26,6 +70,9 @@ func (s *SevenTVEmote) EmoteID() string {
 }
 
 func (s *SevenTVEmote) TypedName() string {
+	if s.Name == "" && s.Data != nil {
+		return s.Data.Name
+	}
 	return s.Name
 }
 
@@ -34,75 +81,156 @@ func (s *SevenTVEmote) LetterCode() string {
 }
 
 func (s *SevenTVEmote) Type() string {
-	return s.MimeType
+	return NormalizeMimeType(s.format())
+}
+
+func (s *SevenTVEmote) withName(name string) Emote {
+	renamed := *s
+	renamed.Name = name
+	return &renamed
+}
+
+func (s *SevenTVEmote) ZeroWidth() bool {
+	return s.Flags&sevenTVActiveZeroWidthFlag != 0 || (s.Data != nil && s.Data.Flags&sevenTVZeroWidthFlag != 0)
+}
+
+// format returns the format of the image files used for the emote. Still
+// emotes are served as PNGs when possible since they are cheaper to decode.
+func (s *SevenTVEmote) format() string {
+	if s.Data == nil {
+		return sevenTVFormats[0]
+	}
+
+	available := make(map[string]bool)
+	animated := s.Data.Animated
+	for _, f := range s.Data.Host.Files {
+		available[f.Format] = true
+		if f.FrameCount > 1 {
+			animated = true
+		}
+	}
+
+	if !animated && available["PNG"] {
+		return "PNG"
+	}
+	for _, f := range sevenTVFormats {
+		if available[f] {
+			return f
+		}
+	}
+	return sevenTVFormats[0]
+}
+
+// largestFile returns the largest image file of the emote in its format.
+func (s *SevenTVEmote) largestFile() (SevenTVFile, bool) {
+	var res SevenTVFile
+	if s.Data == nil {
+		return res, false
+	}
+
+	format := s.format()
+	for _, f := range s.Data.Host.Files {
+		if f.Format == format && f.Width*f.Height > res.Width*res.Height {
+			res = f
+		}
+	}
+	return res, res.Width > 0 && res.Height > 0
 }
 
 var _ Emote = &SevenTVEmote{}
+var _ ZeroWidthEmote = &SevenTVEmote{}
 
-func GetGlobalSevenTVEmotes() ([]*SevenTVEmote, error) {
-	req, err := http.NewRequest("GET", sevenTVGlobalEmotesEndpoint, nil)
+func GetGlobalSevenTVEmotes(ctx context.Context, fetcher Fetcher, endpoints ProviderEndpoints) ([]*SevenTVEmote, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(sevenTVGlobalEmotesEndpoint, endpoints.APIBase), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	populateHeaders(req)
 
-	resp, err := client.Do(req)
+	resp, err := fetcher.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	var data []*SevenTVEmote
+	var data SevenTVEmoteSet
 	if err := unmarshalResponseBody(resp, &data); err != nil {
 		return nil, err
 	}
 
-	return data, nil
+	for _, e := range data.Emotes {
+		e.cdnBase = endpoints.CDNBase
+	}
+
+	return data.Emotes, nil
+}
+
+func GetChannelSevenTVEmotes(ctx context.Context, fetcher Fetcher, endpoints ProviderEndpoints, channelID string) ([]*SevenTVEmote, error) {
+	data, err := GetSevenTVUserConnection(ctx, fetcher, endpoints, channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.EmoteSet == nil { // no account or no emote set is active
+		return []*SevenTVEmote{}, nil
+	}
+
+	for _, e := range data.EmoteSet.Emotes {
+		e.cdnBase = endpoints.CDNBase
+	}
+
+	return data.EmoteSet.Emotes, nil
 }
 
-func GetChannelSevenTVEmotes(channelID string) ([]*SevenTVEmote, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(sevenTVChannelEmotesEndpoint, channelID), nil)
+// GetSevenTVUserConnection returns the 7TV connection of a Twitch channel,
+// which has an empty emote set if the channel has no 7TV account.
+func GetSevenTVUserConnection(ctx context.Context, fetcher Fetcher, endpoints ProviderEndpoints, channelID string) (*SevenTVUserConnection, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(sevenTVChannelEmotesEndpoint, endpoints.APIBase, channelID), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	populateHeaders(req)
 
-	resp, err := client.Do(req)
+	resp, err := fetcher.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode == http.StatusNotFound { // SevenTV returns 404 if no channel-specific emotes are set
+	if resp.StatusCode == http.StatusNotFound { // SevenTV returns 404 if the channel has no 7TV account
 		_ = resp.Body.Close()
-		return []*SevenTVEmote{}, nil
+		return &SevenTVUserConnection{}, nil
 	}
 
-	var data []*SevenTVEmote
+	var data SevenTVUserConnection
 	if err := unmarshalResponseBody(resp, &data); err != nil {
 		return nil, err
 	}
-
-	return data, nil
+	return &data, nil
 }
 
-func GetSpecificSevenTVEmote(emoteID string) (*SevenTVEmote, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(sevenTVSpecificEmotesEndpoint, emoteID), nil)
+func GetSpecificSevenTVEmote(ctx context.Context, fetcher Fetcher, endpoints ProviderEndpoints, emoteID string) (*SevenTVEmote, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(sevenTVSpecificEmotesEndpoint, endpoints.APIBase, emoteID), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	populateHeaders(req)
 
-	resp, err := client.Do(req)
+	resp, err := fetcher.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	var data SevenTVEmote
+	var data SevenTVEmoteData
 	if err := unmarshalResponseBody(resp, &data); err != nil {
 		return nil, err
 	}
 
-	return &data, nil
+	return &SevenTVEmote{
+		ID:      data.ID,
+		Name:    data.Name,
+		Data:    &data,
+		cdnBase: endpoints.CDNBase,
+	}, nil
 }
@@ -0,0 +1,301 @@
+package emotes
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	sevenTVDefaultEventsURL = "wss://events.7tv.io/v3"
+
+	// 7TV sends heartbeats every 25 seconds or so
+	sevenTVEventsReadTimeout = time.Minute * 2
+	sevenTVLookupTimeout     = time.Second * 30
+
+	sevenTVOpDispatch     = 0
+	sevenTVOpReconnect    = 4
+	sevenTVOpEndOfStream  = 7
+	sevenTVOpSubscribe    = 35
+	sevenTVOpUnsubscribe  = 36
+	sevenTVEmoteSetUpdate = "emote_set.update"
+)
+
+type sevenTVEventMessage struct {
+	Op   int             `json:"op"`
+	Data json.RawMessage `json:"d"`
+}
+
+type sevenTVSubscription struct {
+	Type      string            `json:"type"`
+	Condition map[string]string `json:"condition"`
+}
+
+type sevenTVDispatch struct {
+	Type string           `json:"type"`
+	Body sevenTVChangeMap `json:"body"`
+}
+
+// sevenTVChangeMap describes the changes made to an object, an emote set for
+// emote set updates.
+type sevenTVChangeMap struct {
+	ID    string `json:"id"`
+	Actor *struct {
+		DisplayName string `json:"display_name"`
+	} `json:"actor"`
+	Pushed  []sevenTVChangeField `json:"pushed"`
+	Pulled  []sevenTVChangeField `json:"pulled"`
+	Updated []sevenTVChangeField `json:"updated"`
+}
+
+type sevenTVChangeField struct {
+	Key      string        `json:"key"`
+	Value    *SevenTVEmote `json:"value"`
+	OldValue *SevenTVEmote `json:"old_value"`
+}
+
+// SevenTVLiveSource reports changes to channel emotes from the 7TV EventAPI.
+// It subscribes to updates of the emote set that is active in each channel
+// when it is first watched.
+type SevenTVLiveSource struct {
+	endpoints ProviderEndpoints
+	fetcher   Fetcher
+	socket    *liveSocket
+
+	// Emote set of each subscribed channel, empty while it is looked up
+	channels map[string]string
+	// Subscribed channels using each emote set
+	sets map[string]map[string]bool
+	mu   sync.Mutex
+}
+
+var _ LiveSource = &SevenTVLiveSource{}
+
+// NewSevenTVLiveSource creates a 7TV live source that connects to
+// endpoints.Events and looks up channel emote sets using fetcher.
+func NewSevenTVLiveSource(endpoints ProviderEndpoints, fetcher Fetcher) *SevenTVLiveSource {
+	socket := newLiveSocket(endpoints.Events)
+	socket.readTimeout = sevenTVEventsReadTimeout
+
+	return &SevenTVLiveSource{
+		endpoints: endpoints,
+		fetcher:   fetcher,
+		socket:    socket,
+		channels:  make(map[string]string),
+		sets:      make(map[string]map[string]bool),
+	}
+}
+
+func (s *SevenTVLiveSource) Subscribe(ctx context.Context, channelID string) {
+	s.mu.Lock()
+	if _, ok := s.channels[channelID]; ok {
+		s.mu.Unlock()
+		return
+	}
+	s.channels[channelID] = ""
+	s.mu.Unlock()
+
+	go s.lookUpSet(ctx, channelID)
+}
+
+// lookUpSet subscribes to the emote set of a channel once it is looked up,
+// retrying with backoff until the lookup succeeds or the channel is
+// unsubscribed.
+func (s *SevenTVLiveSource) lookUpSet(ctx context.Context, channelID string) {
+	for failures := 1; ; failures++ {
+		lookupCtx, cancel := context.WithTimeout(ctx, sevenTVLookupTimeout)
+		conn, err := GetSevenTVUserConnection(lookupCtx, s.fetcher, s.endpoints, channelID)
+		cancel()
+		if err == nil {
+			s.subscribeSet(channelID, conn)
+			return
+		}
+
+		delay := s.socket.retryDelay(failures)
+		log.Printf("Look up 7TV emote set of channel %q, retrying in %v: %v\n", channelID, delay, err)
+		if sleepContext(ctx, delay) != nil || !s.lookingUp(channelID) {
+			s.forgetLookup(channelID)
+			return
+		}
+	}
+}
+
+// lookingUp reports whether the emote set of a subscribed channel is still
+// being looked up.
+func (s *SevenTVLiveSource) lookingUp(channelID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	setID, ok := s.channels[channelID]
+	return ok && setID == ""
+}
+
+// forgetLookup removes a channel whose emote set is still being looked up, so
+// that subscribing to it again starts a new lookup.
+func (s *SevenTVLiveSource) forgetLookup(channelID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if setID, ok := s.channels[channelID]; ok && setID == "" {
+		delete(s.channels, channelID)
+	}
+}
+
+func (s *SevenTVLiveSource) subscribeSet(channelID string, conn *SevenTVUserConnection) {
+	if conn.EmoteSet == nil || conn.EmoteSet.ID == "" {
+		s.forgetLookup(channelID)
+		return
+	}
+	setID := conn.EmoteSet.ID
+
+	s.mu.Lock()
+	if current, ok := s.channels[channelID]; !ok || current != "" { // unsubscribed in the meantime
+		s.mu.Unlock()
+		return
+	}
+	s.channels[channelID] = setID
+	channels, ok := s.sets[setID]
+	if !ok {
+		channels = make(map[string]bool)
+		s.sets[setID] = channels
+	}
+	channels[channelID] = true
+	s.mu.Unlock()
+
+	if !ok {
+		s.socket.send(sevenTVSetMessage(sevenTVOpSubscribe, setID))
+	}
+}
+
+func (s *SevenTVLiveSource) Unsubscribe(channelID string) {
+	s.mu.Lock()
+	setID := s.channels[channelID]
+	delete(s.channels, channelID)
+
+	unused := false
+	if channels, ok := s.sets[setID]; ok {
+		delete(channels, channelID)
+		if len(channels) == 0 {
+			delete(s.sets, setID)
+			unused = true
+		}
+	}
+	s.mu.Unlock()
+
+	if unused {
+		s.socket.send(sevenTVSetMessage(sevenTVOpUnsubscribe, setID))
+	}
+}
+
+func (s *SevenTVLiveSource) Run(ctx context.Context, changes chan<- EmoteChange) {
+	s.socket.run(ctx, s.resubscribe, func(data []byte) {
+		var msg sevenTVEventMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("Parse 7TV live update: %v\n", err)
+			return
+		}
+
+		switch msg.Op {
+		case sevenTVOpDispatch:
+			var dispatch sevenTVDispatch
+			if err := json.Unmarshal(msg.Data, &dispatch); err != nil {
+				log.Printf("Parse 7TV live update: %v\n", err)
+				return
+			}
+			for _, change := range s.setChanges(&dispatch) {
+				select {
+				case changes <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+		case sevenTVOpReconnect, sevenTVOpEndOfStream:
+			s.socket.reconnect()
+		}
+	})
+}
+
+func (s *SevenTVLiveSource) resubscribe() {
+	s.mu.Lock()
+	sets := make([]string, 0, len(s.sets))
+	for setID := range s.sets {
+		sets = append(sets, setID)
+	}
+	s.mu.Unlock()
+
+	for _, setID := range sets {
+		s.socket.send(sevenTVSetMessage(sevenTVOpSubscribe, setID))
+	}
+}
+
+// setChanges converts an emote set update to changes of every channel using
+// the set.
+func (s *SevenTVLiveSource) setChanges(dispatch *sevenTVDispatch) []EmoteChange {
+	if dispatch.Type != sevenTVEmoteSetUpdate {
+		return nil
+	}
+	body := &dispatch.Body
+
+	actor := ""
+	if body.Actor != nil {
+		actor = body.Actor.DisplayName
+	}
+
+	var setChanges []EmoteChange
+	for _, field := range body.Pushed {
+		if field.Key == "emotes" && field.Value != nil {
+			field.Value.cdnBase = s.endpoints.CDNBase
+			setChanges = append(setChanges, EmoteChange{
+				Kind:    EmoteAdded,
+				EmoteID: field.Value.ID,
+				Emote:   field.Value,
+				Name:    field.Value.TypedName(),
+			})
+		}
+	}
+	for _, field := range body.Pulled {
+		if field.Key == "emotes" && field.OldValue != nil {
+			setChanges = append(setChanges, EmoteChange{
+				Kind:    EmoteRemoved,
+				EmoteID: field.OldValue.ID,
+				Name:    field.OldValue.TypedName(),
+			})
+		}
+	}
+	for _, field := range body.Updated {
+		if field.Key == "emotes" && field.Value != nil && field.OldValue != nil && field.Value.Name != field.OldValue.Name {
+			setChanges = append(setChanges, EmoteChange{
+				Kind:    EmoteRenamed,
+				EmoteID: field.Value.ID,
+				Name:    field.Value.TypedName(),
+				OldName: field.OldValue.TypedName(),
+			})
+		}
+	}
+
+	s.mu.Lock()
+	channels := make([]string, 0, len(s.sets[body.ID]))
+	for channelID := range s.sets[body.ID] {
+		channels = append(channels, channelID)
+	}
+	s.mu.Unlock()
+
+	var res []EmoteChange
+	for _, channelID := range channels {
+		for _, change := range setChanges {
+			change.ChannelID = channelID
+			change.Provider = 's'
+			change.Actor = actor
+			res = append(res, change)
+		}
+	}
+	return res
+}
+
+func sevenTVSetMessage(op int, setID string) sevenTVEventMessage {
+	data, _ := json.Marshal(sevenTVSubscription{
+		Type:      sevenTVEmoteSetUpdate,
+		Condition: map[string]string{"object_id": setID},
+	})
+	return sevenTVEventMessage{Op: op, Data: data}
+}
@@ -0,0 +1,287 @@
+package emotes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"sort"
+)
+
+const (
+	// Pixels less opaque than this are transparent in GIF output
+	gifAlphaThreshold = 0x80
+	// Maximum number of pixels sampled when building a GIF palette
+	gifPaletteSamples = 1 << 16
+
+	// Limits on decoded canvases, which are allocated for every frame of an
+	// animation before it is resized
+	maxCanvasSide      = 4096
+	maxAnimationPixels = 1 << 25
+)
+
+var errInvalidCanvas = errors.New("invalid image canvas")
+
+// animation is a decoded emote image. Every frame is composited onto the full
+// canvas, so frames can be processed independently. Static images have a
+// single frame.
+type animation struct {
+	frames []image.Image
+	// Frame delays in 100ths of a second
+	delays    []int
+	loopCount int
+}
+
+func staticAnimation(img image.Image) *animation {
+	return &animation{
+		frames: []image.Image{img},
+		delays: []int{0},
+	}
+}
+
+func (a *animation) animated() bool {
+	return len(a.frames) > 1
+}
+
+// mapFrames returns a copy of the animation with fn applied to every frame.
+func (a *animation) mapFrames(fn func(image.Image) image.Image) *animation {
+	frames := make([]image.Image, len(a.frames))
+	for i, frame := range a.frames {
+		frames[i] = fn(frame)
+	}
+	return &animation{
+		frames:    frames,
+		delays:    a.delays,
+		loopCount: a.loopCount,
+	}
+}
+
+// checkCanvas rejects canvases that are empty or would take too much memory
+// to allocate for frames frames.
+func checkCanvas(width, height, frames int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("%w: empty %dx%d canvas", errInvalidCanvas, width, height)
+	} else if width > maxCanvasSide || height > maxCanvasSide {
+		return fmt.Errorf("%w: %dx%d canvas is too large", errInvalidCanvas, width, height)
+	} else if int64(width)*int64(height)*int64(frames) > maxAnimationPixels {
+		return fmt.Errorf("%w: %d frames of %dx%d are too large", errInvalidCanvas, frames, width, height)
+	}
+	return nil
+}
+
+// coalesceGif composites the frames of g up to and including frame last,
+// honoring each frame's disposal method.
+func coalesceGif(g *gif.GIF, last int) (*animation, error) {
+	width, height := g.Config.Width, g.Config.Height
+	if width == 0 || height == 0 {
+		width, height = getGifDimensions(g)
+	}
+
+	frames := len(g.Image)
+	if last+1 < frames {
+		frames = last + 1
+	}
+	if err := checkCanvas(width, height, frames); err != nil {
+		return nil, err
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	res := &animation{
+		frames:    make([]image.Image, 0, last+1),
+		delays:    make([]int, 0, last+1),
+		loopCount: g.LoopCount,
+	}
+
+	for i := 0; i <= last && i < len(g.Image); i++ {
+		frame := g.Image[i]
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		res.frames = append(res.frames, cloneRGBA(canvas))
+		if i < len(g.Delay) {
+			res.delays = append(res.delays, g.Delay[i])
+		} else {
+			res.delays = append(res.delays, 0)
+		}
+
+		// Prepare the canvas for the next frame
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return res, nil
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	res := image.NewRGBA(img.Rect)
+	copy(res.Pix, img.Pix)
+	return res
+}
+
+// encodeGif encodes an animation as a GIF with a palette shared by every
+// frame. Each frame replaces the previous one entirely.
+func encodeGif(a *animation) ([]byte, error) {
+	palette := buildGifPalette(a.frames)
+	indexes := make(map[color.NRGBA]uint8)
+
+	g := &gif.GIF{
+		Image:     make([]*image.Paletted, len(a.frames)),
+		Delay:     a.delays,
+		Disposal:  make([]byte, len(a.frames)),
+		LoopCount: a.loopCount,
+	}
+	for i, frame := range a.frames {
+		g.Image[i] = palettedFrame(frame, palette, indexes)
+		g.Disposal[i] = gif.DisposalBackground
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// palettedFrame converts a frame to palette, using index 0 for transparent
+// pixels. indexes caches palette lookups between frames.
+func palettedFrame(frame image.Image, palette color.Palette, indexes map[color.NRGBA]uint8) *image.Paletted {
+	bounds := frame.Bounds()
+	res := image.NewPaletted(bounds, palette)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(frame.At(x, y)).(color.NRGBA)
+			if c.A < gifAlphaThreshold {
+				res.SetColorIndex(x, y, 0)
+				continue
+			}
+
+			c.A = 0xff
+			idx, ok := indexes[c]
+			if !ok {
+				idx = uint8(palette[1:].Index(c) + 1)
+				indexes[c] = idx
+			}
+			res.SetColorIndex(x, y, idx)
+		}
+	}
+	return res
+}
+
+// buildGifPalette builds a palette of a transparent color followed by up to
+// 255 opaque colors picked from frames with the median cut algorithm.
+func buildGifPalette(frames []image.Image) color.Palette {
+	total := 0
+	for _, frame := range frames {
+		total += frame.Bounds().Dx() * frame.Bounds().Dy()
+	}
+	stride := total/gifPaletteSamples + 1
+
+	var pixels [][3]uint8
+	n := 0
+	for _, frame := range frames {
+		bounds := frame.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				n++
+				if n%stride != 0 {
+					continue
+				}
+
+				c := color.NRGBAModel.Convert(frame.At(x, y)).(color.NRGBA)
+				if c.A >= gifAlphaThreshold {
+					pixels = append(pixels, [3]uint8{c.R, c.G, c.B})
+				}
+			}
+		}
+	}
+
+	palette := color.Palette{color.Transparent}
+	if len(pixels) == 0 {
+		// gif.EncodeAll requires at least one color besides transparency
+		return append(palette, color.Black)
+	}
+	return append(palette, medianCut(pixels, 255)...)
+}
+
+// medianCut reduces pixels to at most n colors by repeatedly splitting the
+// group of pixels with the widest channel range at its median.
+func medianCut(pixels [][3]uint8, n int) color.Palette {
+	boxes := [][][3]uint8{pixels}
+	for len(boxes) < n {
+		best, bestChannel, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if channel, r := widestChannel(box); r > bestRange {
+				best, bestChannel, bestRange = i, channel, r
+			}
+		}
+		if best == -1 { // every box holds a single color
+			break
+		}
+
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool {
+			return box[i][bestChannel] < box[j][bestChannel]
+		})
+		mid := len(box) / 2
+		boxes[best] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		var sum [3]int
+		for _, p := range box {
+			sum[0] += int(p[0])
+			sum[1] += int(p[1])
+			sum[2] += int(p[2])
+		}
+		palette[i] = color.RGBA{
+			R: uint8(sum[0] / len(box)),
+			G: uint8(sum[1] / len(box)),
+			B: uint8(sum[2] / len(box)),
+			A: 0xff,
+		}
+	}
+	return palette
+}
+
+func widestChannel(box [][3]uint8) (int, int) {
+	lo := [3]uint8{0xff, 0xff, 0xff}
+	var hi [3]uint8
+	for _, p := range box {
+		for c := 0; c < 3; c++ {
+			if p[c] < lo[c] {
+				lo[c] = p[c]
+			}
+			if p[c] > hi[c] {
+				hi[c] = p[c]
+			}
+		}
+	}
+
+	channel, r := 0, 0
+	for c := 0; c < 3; c++ {
+		if d := int(hi[c]) - int(lo[c]); d > r {
+			channel, r = c, d
+		}
+	}
+	return channel, r
+}
@@ -0,0 +1,78 @@
+package emotes
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func encodeTestGif(t *testing.T, width, height, frames int) []byte {
+	palette := color.Palette{color.Transparent, color.White, color.Black}
+	g := &gif.GIF{
+		Config: image.Config{
+			ColorModel: palette,
+			Width:      width,
+			Height:     height,
+		},
+	}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 2, 2), palette)
+		frame.SetColorIndex(i%2, 0, 1)
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 5)
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("encode test gif: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeGifCanvasLimits(t *testing.T) {
+	emote := &BttvEmote{ID: "gif", Code: "Gif", ImageType: "gif"}
+	tests := []struct {
+		name          string
+		width, height int
+		frames        int
+		ok            bool
+	}{
+		{"Small", 4, 4, 3, true},
+		{"HugeScreen", 60000, 60000, 2, false},
+		{"WideScreen", maxCanvasSide + 1, 2, 2, false},
+		{"TooManyFrames", 2048, 2048, 10, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encodeTestGif(t, tt.width, tt.height, tt.frames)
+			for _, animated := range []bool{true, false} {
+				anim, err := decodeImage(emote, MimeTypeGIF, data, animated)
+				if tt.ok {
+					if err != nil {
+						t.Fatalf("decode (animated = %v): %v", animated, err)
+					}
+					if b := anim.frames[0].Bounds(); animated && (b.Dx() != tt.width || b.Dy() != tt.height) {
+						t.Errorf("frame bounds = %v, want %dx%d canvas", b, tt.width, tt.height)
+					}
+				} else if animated && (!errors.Is(err, ErrDecode) || !errors.Is(err, errInvalidCanvas)) {
+					t.Errorf("decode (animated = %v) error = %v, want ErrDecode", animated, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCoalesceGifLimitsIdealFrame(t *testing.T) {
+	g, err := gif.DecodeAll(bytes.NewReader(encodeTestGif(t, 60000, 60000, 3)))
+	if err != nil {
+		t.Fatalf("decode test gif: %v", err)
+	}
+	if _, err := getGifFrame(g, 2); !errors.Is(err, errInvalidCanvas) {
+		t.Errorf("getGifFrame error = %v, want errInvalidCanvas", err)
+	}
+}
@@ -1,20 +1,17 @@
 package emotes
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-	"time"
 )
 
 const (
 	userAgent = "twitch-mobile-emotes/1.0"
 )
 
-var client = http.Client{
-	Timeout: time.Second * 5,
-}
-
 func populateHeaders(req *http.Request) {
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("User-Agent", userAgent)
@@ -22,9 +19,47 @@ func populateHeaders(req *http.Request) {
 
 func unmarshalResponseBody(resp *http.Response, data interface{}) error {
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
+		// Providers respond with 400 to malformed IDs
+		return fmt.Errorf("%w: status %q", ErrNotFound, resp.Status)
+	} else if isUnavailableStatus(resp.StatusCode) {
+		return fmt.Errorf("%w: status %q", ErrUpstreamUnavailable, resp.Status)
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
 	return json.Unmarshal(b, data)
 }
+
+func getImage(ctx context.Context, fetcher Fetcher, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := fetcher.Do(req)
+	if err != nil {
+		return nil, withKind(ErrUpstreamUnavailable, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_ = resp.Body.Close()
+		err := fmt.Errorf("unexpected status %q from %s", resp.Status, url)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, withKind(ErrNotFound, err)
+		} else if isUnavailableStatus(resp.StatusCode) {
+			return nil, withKind(ErrUpstreamUnavailable, err)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+func isUnavailableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
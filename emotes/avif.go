@@ -0,0 +1,193 @@
+package emotes
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// AVIF emotes aren't decoded: there is no AV1 decoder in the standard library
+// or among this module's dependencies, so they are redirected to their
+// provider's CDN instead of being cached, resized or split. Only the size of
+// their primary image is read, so that aspect ratios still work.
+
+var errInvalidAVIF = errors.New("invalid avif")
+
+// decodeAVIFConfig returns the size of the primary image of an AVIF file from
+// its image spatial extents property, accounting for rotation.
+func decodeAVIFConfig(data []byte) (image.Config, error) {
+	boxes, err := parseISOBoxes(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	ftyp, ok := findISOBox(boxes, "ftyp")
+	if !ok || len(ftyp.data) < 4 {
+		return image.Config{}, fmt.Errorf("%w: missing ftyp", errInvalidAVIF)
+	}
+	meta, ok := findISOBox(boxes, "meta")
+	if !ok || len(meta.data) < 4 {
+		return image.Config{}, fmt.Errorf("%w: missing meta", errInvalidAVIF)
+	}
+
+	metaBoxes, err := parseISOBoxes(meta.data[4:]) // skip version and flags
+	if err != nil {
+		return image.Config{}, err
+	}
+	iprp, ok := findISOBox(metaBoxes, "iprp")
+	if !ok {
+		return image.Config{}, fmt.Errorf("%w: missing iprp", errInvalidAVIF)
+	}
+	iprpBoxes, err := parseISOBoxes(iprp.data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	ipco, ok := findISOBox(iprpBoxes, "ipco")
+	if !ok {
+		return image.Config{}, fmt.Errorf("%w: missing ipco", errInvalidAVIF)
+	}
+	properties, err := parseISOBoxes(ipco.data)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	// Properties of the primary item, or every property if the associations
+	// can't be worked out
+	associated := properties
+	if pitm, ok := findISOBox(metaBoxes, "pitm"); ok {
+		if ipma, ok := findISOBox(iprpBoxes, "ipma"); ok {
+			if indexes, err := primaryItemProperties(pitm.data, ipma.data); err == nil {
+				associated = nil
+				for _, idx := range indexes {
+					if idx > 0 && idx <= len(properties) {
+						associated = append(associated, properties[idx-1])
+					}
+				}
+			}
+		}
+	}
+
+	ispe, ok := findISOBox(associated, "ispe")
+	if !ok || len(ispe.data) < 12 {
+		return image.Config{}, fmt.Errorf("%w: missing ispe", errInvalidAVIF)
+	}
+	width := int(binary.BigEndian.Uint32(ispe.data[4:8]))
+	height := int(binary.BigEndian.Uint32(ispe.data[8:12]))
+
+	if irot, ok := findISOBox(associated, "irot"); ok && len(irot.data) > 0 && irot.data[0]&1 == 1 {
+		// rotated by 90 or 270 degrees
+		width, height = height, width
+	}
+
+	if width == 0 || height == 0 {
+		return image.Config{}, fmt.Errorf("%w: empty image", errInvalidAVIF)
+	}
+	return image.Config{Width: width, Height: height}, nil
+}
+
+// primaryItemProperties returns the 1-based ipco indexes of the properties
+// associated with the primary item.
+func primaryItemProperties(pitm, ipma []byte) ([]int, error) {
+	if len(pitm) < 6 || len(ipma) < 8 {
+		return nil, errInvalidAVIF
+	}
+
+	var primary uint32
+	if pitm[0] == 0 {
+		primary = uint32(binary.BigEndian.Uint16(pitm[4:6]))
+	} else if len(pitm) >= 8 {
+		primary = binary.BigEndian.Uint32(pitm[4:8])
+	} else {
+		return nil, errInvalidAVIF
+	}
+
+	version, flags := ipma[0], ipma[3]
+	count := binary.BigEndian.Uint32(ipma[4:8])
+	data := ipma[8:]
+	for i := uint32(0); i < count; i++ {
+		var item uint32
+		if version < 1 {
+			if len(data) < 3 {
+				return nil, errInvalidAVIF
+			}
+			item = uint32(binary.BigEndian.Uint16(data))
+			data = data[2:]
+		} else {
+			if len(data) < 5 {
+				return nil, errInvalidAVIF
+			}
+			item = binary.BigEndian.Uint32(data)
+			data = data[4:]
+		}
+
+		n := int(data[0])
+		data = data[1:]
+		var indexes []int
+		for j := 0; j < n; j++ {
+			if flags&1 == 1 {
+				if len(data) < 2 {
+					return nil, errInvalidAVIF
+				}
+				indexes = append(indexes, int(binary.BigEndian.Uint16(data)&0x7fff))
+				data = data[2:]
+			} else {
+				if len(data) < 1 {
+					return nil, errInvalidAVIF
+				}
+				indexes = append(indexes, int(data[0]&0x7f))
+				data = data[1:]
+			}
+		}
+
+		if item == primary {
+			return indexes, nil
+		}
+	}
+	return nil, errInvalidAVIF
+}
+
+type isoBox struct {
+	typ  string
+	data []byte
+}
+
+// parseISOBoxes splits data into ISO base media file format boxes.
+func parseISOBoxes(data []byte) ([]isoBox, error) {
+	var boxes []isoBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("%w: truncated box header", errInvalidAVIF)
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		typ := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0: // extends to the end of the data
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("%w: truncated box header", errInvalidAVIF)
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			header = 16
+		}
+
+		if size < header || size > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: truncated %q box", errInvalidAVIF, typ)
+		}
+		boxes = append(boxes, isoBox{typ: typ, data: data[header:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+func findISOBox(boxes []isoBox, typ string) (isoBox, bool) {
+	for _, box := range boxes {
+		if box.typ == typ {
+			return box, true
+		}
+	}
+	return isoBox{}, false
+}
@@ -0,0 +1,84 @@
+package emotes
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func isoBoxBytes(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	res := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(res, uint32(size))
+	copy(res[4:], typ)
+	for _, p := range payload {
+		res = append(res, p...)
+	}
+	return res
+}
+
+// testAVIFHeader returns the boxes of an AVIF file up to its item properties,
+// with the primary item's size in ispe and optionally rotated by 90 degrees.
+func testAVIFHeader(width, height uint32, rotated bool) []byte {
+	ispe := make([]byte, 12)
+	binary.BigEndian.PutUint32(ispe[4:8], width)
+	binary.BigEndian.PutUint32(ispe[8:12], height)
+
+	properties := [][]byte{isoBoxBytes("ispe", ispe)}
+	if rotated {
+		properties = append(properties, isoBoxBytes("irot", []byte{1}))
+	}
+
+	// Item 1 is associated with both properties
+	ipma := []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 2, 1, 2}
+	pitm := []byte{0, 0, 0, 0, 0, 1}
+
+	return append(
+		isoBoxBytes("ftyp", []byte("avif\x00\x00\x00\x00avifmif1")),
+		isoBoxBytes("meta", []byte{0, 0, 0, 0},
+			isoBoxBytes("pitm", pitm),
+			isoBoxBytes("iprp",
+				isoBoxBytes("ipco", properties...),
+				isoBoxBytes("ipma", ipma),
+			),
+		)...,
+	)
+}
+
+func TestDecodeAVIFConfig(t *testing.T) {
+	cfg, err := decodeAVIFConfig(testAVIFHeader(224, 112, false))
+	if err != nil || cfg.Width != 224 || cfg.Height != 112 {
+		t.Errorf("decodeAVIFConfig = %dx%d, %v, want 224x112", cfg.Width, cfg.Height, err)
+	}
+
+	cfg, err = decodeAVIFConfig(testAVIFHeader(224, 112, true))
+	if err != nil || cfg.Width != 112 || cfg.Height != 224 {
+		t.Errorf("decodeAVIFConfig of rotated image = %dx%d, %v, want 112x224", cfg.Width, cfg.Height, err)
+	}
+
+	if _, err := decodeAVIFConfig(testAVIFHeader(224, 112, false)[:40]); err == nil {
+		t.Error("decodeAVIFConfig of truncated file succeeded")
+	}
+}
+
+func TestAVIFEmotesAreRedirected(t *testing.T) {
+	// No AVIF decoder is linked in, so AVIF emotes must not be processed
+	emote := &SevenTVEmote{ID: "avif", Data: &SevenTVEmoteData{
+		Host: SevenTVHost{Files: []SevenTVFile{{Name: "1x.avif", Format: "AVIF"}}},
+	}}
+	if emote.Type() != MimeTypeAVIF {
+		t.Fatalf("Type() = %q, want %q", emote.Type(), MimeTypeAVIF)
+	}
+	if !ShouldNotCache(emote) {
+		t.Error("AVIF emote would be processed without a decoder")
+	}
+
+	_, err := decodeImage(emote, MimeTypeAVIF, testAVIFHeader(224, 112, false), false)
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("decodeImage error = %v, want ErrUnsupportedFormat", err)
+	}
+}
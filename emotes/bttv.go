@@ -1,29 +1,67 @@
 package emotes
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 )
 
 const (
-	bttvGlobalEmotesEndpoint  = "https://api.betterttv.net/3/cached/emotes/global"
-	bttvChannelEmotesEndpoint = "https://api.betterttv.net/3/cached/users/twitch/%s"
-	bttvSpecificEmoteEndpoint = "https://api.betterttv.net/3/emotes/%s"
+	bttvDefaultAPIBase = "https://api.betterttv.net/3"
+
+	bttvGlobalEmotesEndpoint  = "%s/cached/emotes/global"
+	bttvChannelEmotesEndpoint = "%s/cached/users/twitch/%s"
+	bttvSpecificEmoteEndpoint = "%s/emotes/%s"
 )
 
+// BTTV doesn't flag its zero-width emotes in API responses, they are a fixed
+// set of global emotes. Only the global emotes with these names are
+// zero-width, channel and shared emotes that happen to share a name aren't.
+var bttvZeroWidthGlobals = map[string]bool{
+	"cvHazmat":  true,
+	"cvMask":    true,
+	"SoSnowy":   true,
+	"IceCold":   true,
+	"SantaHat":  true,
+	"TopHat":    true,
+	"ReinDeer":  true,
+	"CandyCane": true,
+}
+
 type BttvEmote struct {
 	ID        string `json:"id"`
 	Code      string `json:"code"`
 	ImageType string `json:"imageType"`
+
+	cdnBase string
+	// Set on the global zero-width emotes when they are loaded, so that it
+	// follows the emote's ID rather than its name
+	zeroWidth bool
 }
 
 var _ Emote = &BttvEmote{}
+var _ ZeroWidthEmote = &BttvEmote{}
+var _ globalEmote = &BttvEmote{}
 
 type BttvChannelResponse struct {
 	ChanEmotes   []*BttvEmote `json:"channelEmotes"`
 	SharedEmotes []*BttvEmote `json:"sharedEmotes"`
 }
 
+func (b *BttvEmote) ZeroWidth() bool {
+	return b.zeroWidth
+}
+
+func (b *BttvEmote) markGlobal() {
+	b.zeroWidth = bttvZeroWidthGlobals[b.Code]
+}
+
+func (b *BttvEmote) withName(name string) Emote {
+	renamed := *b
+	renamed.Code = name
+	return &renamed
+}
+
 func (b *BttvEmote) EmoteID() string {
 	return b.ID
 }
@@ -37,18 +75,18 @@ func (b *BttvEmote) LetterCode() string {
 }
 
 func (b *BttvEmote) Type() string {
-	return b.ImageType
+	return NormalizeMimeType(b.ImageType)
 }
 
-func GetGlobalBTTVEmotes() ([]*BttvEmote, error) {
-	req, err := http.NewRequest("GET", bttvGlobalEmotesEndpoint, nil)
+func GetGlobalBTTVEmotes(ctx context.Context, fetcher Fetcher, endpoints ProviderEndpoints) ([]*BttvEmote, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(bttvGlobalEmotesEndpoint, endpoints.APIBase), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	populateHeaders(req)
 
-	resp, err := client.Do(req)
+	resp, err := fetcher.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -58,22 +96,32 @@ func GetGlobalBTTVEmotes() ([]*BttvEmote, error) {
 		return nil, err
 	}
 
+	for _, e := range data {
+		e.cdnBase = endpoints.CDNBase
+		e.markGlobal()
+	}
+
 	return data, nil
 }
 
-func GetChannelBTTVEmotes(channelID string) ([]*BttvEmote, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(bttvChannelEmotesEndpoint, channelID), nil)
+func GetChannelBTTVEmotes(ctx context.Context, fetcher Fetcher, endpoints ProviderEndpoints, channelID string) ([]*BttvEmote, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(bttvChannelEmotesEndpoint, endpoints.APIBase, channelID), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	populateHeaders(req)
 
-	resp, err := client.Do(req)
+	resp, err := fetcher.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
+	if resp.StatusCode == http.StatusNotFound { // BTTV returns 404 if the user has never used BTTV
+		_ = resp.Body.Close()
+		return []*BttvEmote{}, nil
+	}
+
 	var data BttvChannelResponse
 	if err := unmarshalResponseBody(resp, &data); err != nil {
 		return nil, err
@@ -82,19 +130,22 @@ func GetChannelBTTVEmotes(channelID string) ([]*BttvEmote, error) {
 	var es []*BttvEmote
 	es = append(es, data.ChanEmotes...)
 	es = append(es, data.SharedEmotes...)
+	for _, e := range es {
+		e.cdnBase = endpoints.CDNBase
+	}
 
 	return es, nil
 }
 
-func GetSpecificBTTVEmote(emoteID string) (*BttvEmote, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(bttvSpecificEmoteEndpoint, emoteID), nil)
+func GetSpecificBTTVEmote(ctx context.Context, fetcher Fetcher, endpoints ProviderEndpoints, emoteID string) (*BttvEmote, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(bttvSpecificEmoteEndpoint, endpoints.APIBase, emoteID), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	populateHeaders(req)
 
-	resp, err := client.Do(req)
+	resp, err := fetcher.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -103,6 +154,7 @@ func GetSpecificBTTVEmote(emoteID string) (*BttvEmote, error) {
 	if err := unmarshalResponseBody(resp, &data); err != nil {
 		return nil, err
 	}
+	data.cdnBase = endpoints.CDNBase
 
 	return &data, nil
 }
@@ -0,0 +1,147 @@
+package emotes
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+)
+
+const (
+	bttvDefaultEventsURL = "wss://sockets.betterttv.net/ws"
+
+	bttvChannelPrefix = "twitch:"
+)
+
+type bttvSocketMessage struct {
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data"`
+}
+
+type bttvChannelData struct {
+	Name string `json:"name"`
+}
+
+type bttvEmoteEvent struct {
+	Channel string     `json:"channel"`
+	Emote   *BttvEmote `json:"emote"`
+	EmoteID string     `json:"emoteId"`
+}
+
+// BttvLiveSource reports changes to channel emotes from BTTV's socket.
+type BttvLiveSource struct {
+	endpoints ProviderEndpoints
+	socket    *liveSocket
+
+	channels map[string]bool
+	mu       sync.Mutex
+}
+
+var _ LiveSource = &BttvLiveSource{}
+
+// NewBttvLiveSource creates a BTTV live source that connects to
+// endpoints.Events.
+func NewBttvLiveSource(endpoints ProviderEndpoints) *BttvLiveSource {
+	return &BttvLiveSource{
+		endpoints: endpoints,
+		socket:    newLiveSocket(endpoints.Events),
+		channels:  make(map[string]bool),
+	}
+}
+
+func (b *BttvLiveSource) Subscribe(_ context.Context, channelID string) {
+	b.mu.Lock()
+	b.channels[channelID] = true
+	b.mu.Unlock()
+	b.socket.send(bttvChannelMessage("join_channel", channelID))
+}
+
+func (b *BttvLiveSource) Unsubscribe(channelID string) {
+	b.mu.Lock()
+	delete(b.channels, channelID)
+	b.mu.Unlock()
+	b.socket.send(bttvChannelMessage("part_channel", channelID))
+}
+
+func (b *BttvLiveSource) Run(ctx context.Context, changes chan<- EmoteChange) {
+	b.socket.run(ctx, b.resubscribe, func(data []byte) {
+		change, ok, err := b.parseMessage(data)
+		if err != nil {
+			log.Printf("Parse BTTV live update: %v\n", err)
+		} else if ok {
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+			}
+		}
+	})
+}
+
+func (b *BttvLiveSource) resubscribe() {
+	b.mu.Lock()
+	channels := make([]string, 0, len(b.channels))
+	for channelID := range b.channels {
+		channels = append(channels, channelID)
+	}
+	b.mu.Unlock()
+
+	for _, channelID := range channels {
+		b.socket.send(bttvChannelMessage("join_channel", channelID))
+	}
+}
+
+// parseMessage converts a socket message to a change, if it is one.
+func (b *BttvLiveSource) parseMessage(data []byte) (EmoteChange, bool, error) {
+	var msg bttvSocketMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return EmoteChange{}, false, err
+	}
+
+	var kind EmoteChangeKind
+	switch msg.Name {
+	case "emote_create":
+		kind = EmoteAdded
+	case "emote_update":
+		kind = EmoteRenamed
+	case "emote_delete":
+		kind = EmoteRemoved
+	default:
+		return EmoteChange{}, false, nil
+	}
+
+	var event bttvEmoteEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		return EmoteChange{}, false, err
+	}
+	if !strings.HasPrefix(event.Channel, bttvChannelPrefix) {
+		return EmoteChange{}, false, nil // not a Twitch channel
+	}
+
+	change := EmoteChange{
+		ChannelID: strings.TrimPrefix(event.Channel, bttvChannelPrefix),
+		Kind:      kind,
+		Provider:  'b',
+		EmoteID:   event.EmoteID,
+	}
+
+	if kind != EmoteRemoved {
+		if event.Emote == nil || event.Emote.ID == "" {
+			return EmoteChange{}, false, errLiveMessage
+		}
+		change.EmoteID = event.Emote.ID
+		change.Name = event.Emote.Code
+		if kind == EmoteAdded {
+			event.Emote.cdnBase = b.endpoints.CDNBase
+			change.Emote = event.Emote
+		}
+	} else if change.EmoteID == "" {
+		return EmoteChange{}, false, errLiveMessage
+	}
+	return change, true, nil
+}
+
+func bttvChannelMessage(name, channelID string) bttvSocketMessage {
+	data, _ := json.Marshal(bttvChannelData{Name: bttvChannelPrefix + channelID})
+	return bttvSocketMessage{Name: name, Data: data}
+}
@@ -0,0 +1,68 @@
+package emotes
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBttvZeroWidthFollowsGlobalEmoteID(t *testing.T) {
+	providers := newFakeProviders(t)
+	providers['b'].setResponse("/cached/emotes/global", `[{"id":"zw","code":"TopHat","imageType":"png"},{"id":"bg","code":"BttvGlobal","imageType":"png"}]`)
+	providers['b'].setResponse("/cached/users/twitch/"+testChannelID, `{"channelEmotes":[{"id":"ch","code":"cvMask","imageType":"png"}],"sharedEmotes":[]}`)
+
+	store := newTestStore(t, providers)
+	if err := store.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if err := store.LoadIfNotLoaded(context.Background(), testChannelID); err != nil {
+		t.Fatalf("LoadIfNotLoaded: %v", err)
+	}
+
+	zeroWidth := func(id string) bool {
+		t.Helper()
+		e, ok := store.GetEmote(context.Background(), 'b', id)
+		if !ok {
+			t.Fatalf("emote %q not found", id)
+		}
+		return IsZeroWidth(e)
+	}
+	if !zeroWidth("zw") {
+		t.Error("global TopHat isn't zero-width")
+	}
+	if zeroWidth("bg") {
+		t.Error("global BttvGlobal is zero-width")
+	}
+	if zeroWidth("ch") {
+		t.Error("channel emote named cvMask is zero-width")
+	}
+
+	// Renaming doesn't change whether an emote is zero-width
+	change := EmoteChange{ChannelID: testChannelID, Kind: EmoteRenamed, Provider: 'b', EmoteID: "ch", Name: "TopHat"}
+	if !store.ApplyChange(&change) {
+		t.Fatal("rename of channel emote changed nothing")
+	}
+	if e, ok := store.GetEmoteFromWord("TopHat", testChannelID); !ok || IsZeroWidth(e) {
+		t.Errorf("renamed channel emote = %v, %v, want found and not zero-width", e, ok)
+	}
+
+	global, _ := store.GetEmote(context.Background(), 'b', "zw")
+	if renamed := global.(renamer).withName("Renamed"); !IsZeroWidth(renamed) {
+		t.Error("renamed global TopHat isn't zero-width")
+	}
+
+	// Restored global emotes are still zero-width
+	snap, err := store.exportSnapshot()
+	if err != nil {
+		t.Fatalf("exportSnapshot: %v", err)
+	}
+	restored := newTestStore(t, providers)
+	if err := restored.restoreSnapshot(snap); err != nil {
+		t.Fatalf("restoreSnapshot: %v", err)
+	}
+	if e, ok := restored.GetEmote(context.Background(), 'b', "zw"); !ok || !IsZeroWidth(e) {
+		t.Errorf("restored global TopHat = %v, %v, want found and zero-width", e, ok)
+	}
+	if e, ok := restored.GetEmote(context.Background(), 'b', "ch"); !ok || IsZeroWidth(e) {
+		t.Errorf("restored channel emote = %v, %v, want found and not zero-width", e, ok)
+	}
+}
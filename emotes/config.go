@@ -0,0 +1,41 @@
+package emotes
+
+// ProviderEndpoints holds the base URLs used to reach a single emote provider.
+type ProviderEndpoints struct {
+	// APIBase is the base URL of the provider's REST API, without a trailing slash.
+	APIBase string
+
+	// CDNBase is the base URL that emote images are served from, without a
+	// trailing slash. If empty, the provider's default CDN (or the image URLs
+	// returned by its API) are used.
+	CDNBase string
+
+	// Events is the URL of the provider's websocket for live emote set
+	// updates. If empty, live updates from the provider are disabled.
+	Events string
+}
+
+// ProviderConfig configures where each emote provider's API and CDN live.
+type ProviderConfig struct {
+	Bttv    ProviderEndpoints
+	Ffz     ProviderEndpoints
+	SevenTV ProviderEndpoints
+}
+
+// DefaultProviderConfig returns a ProviderConfig that points at the public
+// provider endpoints.
+func DefaultProviderConfig() *ProviderConfig {
+	return &ProviderConfig{
+		Bttv: ProviderEndpoints{
+			APIBase: bttvDefaultAPIBase,
+			Events:  bttvDefaultEventsURL,
+		},
+		Ffz: ProviderEndpoints{
+			APIBase: ffzDefaultAPIBase,
+		},
+		SevenTV: ProviderEndpoints{
+			APIBase: sevenTVDefaultAPIBase,
+			Events:  sevenTVDefaultEventsURL,
+		},
+	}
+}
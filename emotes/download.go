@@ -5,88 +5,87 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
-	"golang.org/x/image/webp"
-	"image"
-	"image/gif"
-	"image/png"
-	"io"
-	"log"
-	"os"
-	"path"
-	"path/filepath"
+	"io/ioutil"
+	"strconv"
 	"strings"
-	"sync"
-	"time"
 )
 
+// ShouldNotCache reports whether an emote must be served from its provider's
+// CDN instead of being processed.
 func ShouldNotCache(emote Emote) bool {
-	// webp images seem to be undecodable? TODO: Review in future
-	if emote.Type() == "image/webp" {
-		return true
-	} else {
-		return false
-	}
+	f := lookupFormat(emote.Type())
+	return f == nil || !f.canDecode()
 }
 
-func requestEmote(emote Emote, size ImageSize) (image.Image, error) {
+// requestEmote downloads and decodes an emote. Animated emotes keep all of
+// their frames if animated is set, otherwise a single frame is selected.
+func requestEmote(ctx context.Context, fetcher Fetcher, emote Emote, size ImageSize, animated bool) (*animation, error) {
+	if f := lookupFormat(emote.Type()); f == nil || !f.canDecode() {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedFormat, emote.Type())
+	}
+
 	url := emote.URL(size)
-	resp, err := client.Get(url)
+	resp, err := getImage(ctx, fetcher, url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	var img image.Image
-	switch emote.Type() {
-	case "png":
-		pngImg, err := png.Decode(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-		img = pngImg
-	case "gif":
-		gifImg, err := gif.DecodeAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-		img = selectGifFrame(emote, gifImg)
-	case "webp":
-	case "image/webp":
-		webpImg, err := webp.Decode(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-		img = webpImg
-	default:
-		return nil, fmt.Errorf("unsupported emote type %q", emote.Type())
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, withKind(ErrUpstreamUnavailable, err)
 	}
+	return decodeImage(emote, emote.Type(), data, animated)
+}
 
-	return img, nil
+// keepsAnimation reports whether an emote is processed into an animated image
+// when animated output is requested.
+func keepsAnimation(emote Emote, animated bool) bool {
+	return animated && IsAnimatedType(emote.Type())
 }
 
-func DownloadEmote(emote Emote, size ImageSize) ([]byte, error) {
-	img, err := requestEmote(emote, size)
+func DownloadEmote(ctx context.Context, fetcher Fetcher, emote Emote, size ImageSize, animated bool) ([]byte, error) {
+	anim, err := requestEmote(ctx, fetcher, emote, size, animated)
 	if err != nil {
 		return nil, fmt.Errorf("request emote: %w", err)
 	}
-	return processImage(img, size)
+	return processImage(anim, size)
 }
 
-func DownloadEmoteHalves(emote Emote, size ImageSize) ([]byte, []byte, error) {
-	img, err := requestEmote(emote, size)
+// DownloadEmoteTiles downloads an emote and splits it into count tiles.
+func DownloadEmoteTiles(ctx context.Context, fetcher Fetcher, emote Emote, size ImageSize, count int, animated bool) ([][]byte, error) {
+	anim, err := requestEmote(ctx, fetcher, emote, size, animated)
+	if err != nil {
+		return nil, fmt.Errorf("request emote: %w", err)
+	}
+	tiles, err := processImageTiles(anim, size, count)
 	if err != nil {
-		return nil, nil, fmt.Errorf("request emote: %w", err)
+		return nil, fmt.Errorf("process tiles: %w", err)
 	}
-	l, r, err := processImageHalves(img, size)
+	return tiles, nil
+}
+
+// DownloadModifiedEmote downloads an emote and applies modifiers to it.
+func DownloadModifiedEmote(ctx context.Context, fetcher Fetcher, emote Emote, size ImageSize, m Modifiers, animated bool) ([]byte, error) {
+	anim, err := requestEmote(ctx, fetcher, emote, size, animated)
 	if err != nil {
-		return nil, nil, fmt.Errorf("process halves: %w", err)
+		return nil, fmt.Errorf("request emote: %w", err)
 	}
-	return l, r, nil
+	return processModifiedImage(applyModifiers(anim, m), size, m)
 }
 
-type cacheMapValue struct {
-	path    string
-	created time.Time
+// DownloadEmoteOverlay downloads a base emote and the zero-width emotes drawn
+// over it, and composites them into a single image.
+func DownloadEmoteOverlay(ctx context.Context, fetcher Fetcher, base Emote, overlays []Emote, size ImageSize, animated bool) ([]byte, error) {
+	layers := make([]*animation, 0, len(overlays)+1)
+	for _, emote := range append([]Emote{base}, overlays...) {
+		anim, err := requestEmote(ctx, fetcher, emote, size, animated)
+		if err != nil {
+			return nil, fmt.Errorf("request emote %s%s: %w", emote.LetterCode(), emote.EmoteID(), err)
+		}
+		layers = append(layers, anim)
+	}
+	return processImageOverlay(layers, size)
 }
 
 func hashString(s string) string {
@@ -94,348 +93,112 @@ func hashString(s string) string {
 	return hex.EncodeToString(sum[:])
 }
 
-func getFileKey(emote Emote, size ImageSize) string {
-	return emote.LetterCode() + "_" + emote.EmoteID() + "_" + size.BttvString()
+func getFileKey(emote Emote, size ImageSize, animated bool) string {
+	return emote.LetterCode() + "_" + emote.EmoteID() + "_" + size.BttvString() + animationSuffix(emote, animated)
 }
 
-func getVirtualFileKey(emote Emote, size ImageSize, half VirtualHalf) string {
-	return "v" + half.LetterCode() + "_" + emote.LetterCode() + "_" + emote.EmoteID() + "_" + size.BttvString()
+func getVirtualFileKey(emote Emote, size ImageSize, tile Tile, animated bool) string {
+	return "v" + tile.LetterCode() + "_" + emote.LetterCode() + "_" + emote.EmoteID() + "_" + size.BttvString() + animationSuffix(emote, animated)
 }
 
-func getAspectRatioKey(emote Emote) string {
-	return hashString(emote.LetterCode() + "_" + emote.EmoteID())
+func getModifiedFileKey(emote Emote, size ImageSize, m Modifiers, animated bool) string {
+	return "m" + m.String() + "_" + getFileKey(emote, size, animated)
 }
 
-type ImageFileCache struct {
-	cacheMap       map[string]cacheMapValue
-	aspectRatioMap map[string]float64
-	basePath       string
-	expiration     time.Duration
-	// Remove files older than expiration in the basePath directory
-	cleanOnIndex bool
-
-	mu sync.Mutex
-}
-
-func NewImageFileCache(basePath string, expiration time.Duration, cleanOnIndex bool) *ImageFileCache {
-	return &ImageFileCache{
-		cacheMap:       make(map[string]cacheMapValue),
-		aspectRatioMap: make(map[string]float64),
-		basePath:       basePath,
-		expiration:     expiration,
-		cleanOnIndex:   cleanOnIndex,
+func getOverlayFileKey(base Emote, overlays []Emote, size ImageSize, animated bool) string {
+	key := "o_" + base.LetterCode() + "_" + base.EmoteID()
+	anyAnimated := keepsAnimation(base, animated)
+	for _, o := range overlays {
+		key += "_" + o.LetterCode() + "_" + o.EmoteID()
+		anyAnimated = anyAnimated || keepsAnimation(o, animated)
 	}
-}
 
-func (c *ImageFileCache) Index() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	err := filepath.Walk(c.basePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if !info.IsDir() && filepath.Ext(path) == ".png" {
-			key := strings.TrimSuffix(info.Name(), ".png")
-			if time.Since(info.ModTime()) > c.expiration {
-				if c.cleanOnIndex {
-					if err := os.Remove(path); err != nil {
-						return fmt.Errorf("remove %q: %w", key, err)
-					}
-				}
-				// don't include file in index
-				return nil
-			}
-
-			c.cacheMap[key] = cacheMapValue{
-				path:    path,
-				created: info.ModTime(),
-			}
-		}
-		return nil
-	})
-
-	if err != nil {
-		return fmt.Errorf("cache index: %w", err)
+	key += "_" + size.BttvString()
+	if anyAnimated {
+		key += "_a"
 	}
-	return nil
+	return key
 }
 
-func (c *ImageFileCache) Evict() (int, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	n := 0
-	for key, val := range c.cacheMap {
-		if time.Since(val.created) > c.expiration {
-			if err := os.Remove(val.path); err != nil {
-				return n, fmt.Errorf("remove %q: %w", key, err)
-			}
-			delete(c.cacheMap, key)
-			n++
-		}
+// animationSuffix distinguishes the keys of animated images from those of
+// their static versions.
+func animationSuffix(emote Emote, animated bool) string {
+	if keepsAnimation(emote, animated) {
+		return "_a"
 	}
-	return n, nil
+	return ""
 }
 
-func (c *ImageFileCache) Purge() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	for key, val := range c.cacheMap {
-		if err := os.Remove(val.path); err != nil {
-			return fmt.Errorf("purge %q: %w", key, err)
-		}
-		delete(c.cacheMap, key)
-	}
-
-	return nil
-}
-
-func (c *ImageFileCache) AutoEvict(ctx context.Context) {
-	timer := time.NewTimer(time.Hour)
-	defer timer.Stop()
-
-	for {
-		select {
-		case <-timer.C:
-			if _, err := c.Evict(); err != nil {
-				log.Printf("AutoEvict: %v\n", err)
-			}
-		case <-ctx.Done():
-			return
-		}
-	}
+func getAspectRatioKey(emote Emote) string {
+	return hashString(emote.LetterCode() + "_" + emote.EmoteID())
 }
 
-func (c *ImageFileCache) GetCachedOrDownload(emote Emote, size ImageSize, writer io.Writer) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	key := getFileKey(emote, size)
-	val, exists := c.cacheMap[key]
-	if exists {
-		if writer == nil {
-			return nil
-		}
-
-		f, err := os.Open(val.path)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		_, err = io.Copy(writer, f)
-		return err
-	} else {
-		data, err := DownloadEmote(emote, size)
-		if err != nil {
-			return err
-		}
-
-		if err := c.writeDataToCache(key, data); err != nil {
-			return err
-		}
+// MaxTileCount is the largest number of tiles an emote can be split into.
+const MaxTileCount = 8
 
-		if writer != nil {
-			_, err = writer.Write(data)
-			return err
-		} else {
-			return nil
-		}
-	}
+// Tile identifies one of Count equal-width slices of a wide emote, numbered
+// from the left.
+type Tile struct {
+	Index int
+	Count int
 }
 
-func (c *ImageFileCache) DownloadToCache(emote Emote, size ImageSize) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	key := getFileKey(emote, size)
-	_, exists := c.cacheMap[key]
-	if !exists {
-		data, err := DownloadEmote(emote, size)
-		if err != nil {
-			return err
-		}
+var (
+	LeftHalf  = Tile{Index: 0, Count: 2}
+	RightHalf = Tile{Index: 1, Count: 2}
+)
 
-		if err := c.writeDataToCache(key, data); err != nil {
-			return err
-		}
-	}
-	return nil
+func (t Tile) Valid() bool {
+	return t.Count >= 2 && t.Count <= MaxTileCount && t.Index >= 0 && t.Index < t.Count
 }
 
-type VirtualHalf int
-
-const (
-	LeftHalf VirtualHalf = iota
-	RightHalf
-)
-
-func (h VirtualHalf) LetterCode() string {
-	switch h {
+// LetterCode returns the code of the tile in virtual emote IDs and cache keys.
+// Halves keep the "l" and "r" codes used before emotes could be split into
+// more than two tiles.
+func (t Tile) LetterCode() string {
+	switch t {
 	case LeftHalf:
 		return "l"
 	case RightHalf:
 		return "r"
 	default:
-		return "?"
+		return strconv.Itoa(t.Index) + "of" + strconv.Itoa(t.Count)
 	}
 }
 
-func (c *ImageFileCache) GetCachedOrDownloadHalf(emote Emote, size ImageSize, half VirtualHalf, writer io.Writer) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	key := getVirtualFileKey(emote, size, half)
-	val, exists := c.cacheMap[key]
-	if exists {
-		if writer == nil {
-			return nil
-		}
-
-		f, err := os.Open(val.path)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		_, err = io.Copy(writer, f)
-		return err
-	} else {
-		left, right, err := DownloadEmoteHalves(emote, size)
-		if err != nil {
-			return err
-		}
-
-		leftKey := getVirtualFileKey(emote, size, LeftHalf)
-		rightKey := getVirtualFileKey(emote, size, RightHalf)
-
-		if err := c.writeDataToCache(leftKey, left); err != nil {
-			return err
-		}
-		if err := c.writeDataToCache(rightKey, right); err != nil {
-			return err
-		}
-
-		if writer != nil {
-			var data []byte
-			switch half {
-			case LeftHalf:
-				data = left
-			case RightHalf:
-				data = right
-			default:
-				return fmt.Errorf("unknown half %d", half)
-			}
-
-			_, err = writer.Write(data)
-			return err
-		} else {
-			return nil
+// ParseTile parses the tile code at the start of s, returning the tile and
+// the rest of s.
+func ParseTile(s string) (Tile, string, bool) {
+	if len(s) > 0 {
+		switch s[0] {
+		case 'l':
+			return LeftHalf, s[1:], true
+		case 'r':
+			return RightHalf, s[1:], true
 		}
 	}
-}
-
-func (c *ImageFileCache) DownloadVirtualToCache(emote Emote, size ImageSize) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	leftKey := getVirtualFileKey(emote, size, LeftHalf)
-	rightKey := getVirtualFileKey(emote, size, RightHalf)
-	_, existLeft := c.cacheMap[leftKey]
-	_, existRight := c.cacheMap[rightKey]
-	if !existLeft || !existRight {
-		left, right, err := DownloadEmoteHalves(emote, size)
-		if err != nil {
-			return err
-		}
 
-		if err := c.writeDataToCache(leftKey, left); err != nil {
-			return err
-		}
-		if err := c.writeDataToCache(rightKey, right); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (c *ImageFileCache) writeDataToCache(key string, data []byte) error {
-	fPath := path.Join(c.basePath, key+".png")
-	f, err := os.Create(fPath)
-	if err != nil {
-		return err
+	index, s, ok := parseLeadingInt(s)
+	if !ok || !strings.HasPrefix(s, "of") {
+		return Tile{}, "", false
 	}
-
-	if _, err = f.Write(data); err != nil {
-		return fmt.Errorf("write cache file: %w", err)
+	count, s, ok := parseLeadingInt(s[2:])
+	if !ok {
+		return Tile{}, "", false
 	}
-	f.Close()
 
-	c.cacheMap[key] = cacheMapValue{
-		path:    fPath,
-		created: time.Now(),
-	}
-	return nil
+	t := Tile{Index: index, Count: count}
+	return t, s, t.Valid()
 }
 
-func (c *ImageFileCache) GetEmoteAspectRatio(emote Emote) (float64, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	key := getAspectRatioKey(emote)
-	val, found := c.aspectRatioMap[key]
-	if found {
-		return val, nil
-	}
-
-	if stv, ok := emote.(*SevenTVEmote); ok {
-		// SevenTV provides this emote data in API responses
-		if len(stv.Widths) > 0 {
-			calculated := float64(stv.Widths[len(stv.Widths)-1]) / float64(stv.Heights[len(stv.Heights)-1])
-			c.aspectRatioMap[key] = calculated
-			return calculated, nil
-		}
-	}
-
-	url := emote.URL(ImageSizeSmall)
-	resp, err := client.Get(url)
-	if err != nil {
-		return 0, err
+func parseLeadingInt(s string) (int, string, bool) {
+	n := 0
+	for n < len(s) && n < 2 && s[n] >= '0' && s[n] <= '9' {
+		n++
 	}
-	defer resp.Body.Close()
-
-	var cfg image.Config
-
-	switch emote.Type() {
-	case "png":
-		c, err := png.DecodeConfig(resp.Body)
-		if err != nil {
-			return 0, err
-		}
-		cfg = c
-	case "gif":
-		c, err := gif.DecodeConfig(resp.Body)
-		if err != nil {
-			return 0, err
-		}
-		cfg = c
-	case "webp":
-	case "image/webp":
-		c, err := webp.DecodeConfig(resp.Body)
-		if err != nil {
-			return 0, err
-		}
-		cfg = c
-	default:
-		return 0, fmt.Errorf("unsupported emote type %q", emote.Type())
+	if n == 0 {
+		return 0, s, false
 	}
-
-	calculated := float64(cfg.Width) / float64(cfg.Height)
-
-	c.aspectRatioMap[key] = calculated
-	return calculated, nil
+	v, err := strconv.Atoi(s[:n])
+	return v, s[n:], err == nil
 }
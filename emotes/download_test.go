@@ -0,0 +1,42 @@
+package emotes
+
+import (
+	"testing"
+)
+
+func TestTileLetterCodeRoundTrip(t *testing.T) {
+	for count := 2; count <= MaxTileCount; count++ {
+		for index := 0; index < count; index++ {
+			tile := Tile{Index: index, Count: count}
+			code := tile.LetterCode()
+			got, rest, ok := ParseTile(code + "b123")
+			if !ok || got != tile || rest != "b123" {
+				t.Errorf("ParseTile(%q) = %v, %q, %v, want %v, %q, true", code+"b123", got, rest, ok, tile, "b123")
+			}
+		}
+	}
+
+	if code := LeftHalf.LetterCode(); code != "l" {
+		t.Errorf("LeftHalf.LetterCode() = %q, want %q", code, "l")
+	}
+	if code := RightHalf.LetterCode(); code != "r" {
+		t.Errorf("RightHalf.LetterCode() = %q, want %q", code, "r")
+	}
+}
+
+func TestParseTileInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"b123",
+		"0of",
+		"0f3b123",
+		"3of3b123",
+		"0of1b123",
+		"0of9b123",
+		"100of3b123",
+	} {
+		if tile, _, ok := ParseTile(s); ok {
+			t.Errorf("ParseTile(%q) = %v, want invalid", s, tile)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package emotes
+
+import "errors"
+
+// Errors returned by the package, matched with errors.Is to tell failures
+// apart.
+var (
+	// ErrNotFound is returned when a provider reports that a resource doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrUpstreamUnavailable is returned when a provider can't be reached or
+	// fails to serve a request.
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	// ErrUnsupportedFormat is returned for images in a format we can't process.
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	// ErrDecode is returned when an image can't be decoded.
+	ErrDecode = errors.New("image decode failed")
+)
+
+// kindError tags err with one of the package errors while keeping err in the
+// chain, so both can be matched with errors.Is.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func withKind(kind, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+func (e *kindError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
@@ -0,0 +1,219 @@
+package emotes
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Fetcher performs outbound HTTP requests to emote providers and their CDNs.
+//
+// Implementations must respect the request's context for cancellation.
+type Fetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type FetcherOptions struct {
+	// Timeout is the timeout for a single attempt of a request.
+	Timeout time.Duration
+
+	// MaxRetries is the number of times a request is retried after a
+	// 5xx/429 response or a transport error.
+	MaxRetries int
+
+	// BaseDelay is the initial backoff delay, doubled on every attempt.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the backoff delay and the honored Retry-After value.
+	MaxDelay time.Duration
+
+	// MaxPerHost limits the number of concurrent requests to a single host.
+	// Zero or less means unlimited.
+	MaxPerHost int
+}
+
+func DefaultFetcherOptions() FetcherOptions {
+	return FetcherOptions{
+		Timeout:    time.Second * 5,
+		MaxRetries: 3,
+		BaseDelay:  time.Millisecond * 250,
+		MaxDelay:   time.Second * 5,
+		MaxPerHost: 16,
+	}
+}
+
+// HTTPFetcher is a Fetcher that retries failed requests with exponential
+// backoff and limits concurrency per host.
+type HTTPFetcher struct {
+	client *http.Client
+	opts   FetcherOptions
+
+	hosts map[string]chan struct{}
+	mu    sync.Mutex
+}
+
+var _ Fetcher = &HTTPFetcher{}
+
+// NewHTTPFetcher creates an HTTPFetcher. If client is nil, a client using
+// opts.Timeout is created.
+func NewHTTPFetcher(client *http.Client, opts FetcherOptions) *HTTPFetcher {
+	if client == nil {
+		client = &http.Client{
+			Timeout: opts.Timeout,
+		}
+	}
+
+	return &HTTPFetcher{
+		client: client,
+		opts:   opts,
+		hosts:  make(map[string]chan struct{}),
+	}
+}
+
+func (f *HTTPFetcher) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	// Requests with bodies can only be retried if the body can be recreated
+	canRetry := req.Body == nil || req.GetBody != nil
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		release, err := f.acquireHost(ctx, req.URL.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := f.client.Do(req)
+		lastAttempt := !canRetry || attempt >= f.opts.MaxRetries
+
+		if err != nil {
+			release()
+			if lastAttempt || ctx.Err() != nil {
+				return nil, err
+			}
+			if err := sleepContext(ctx, f.backoff(attempt)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !lastAttempt && isRetryableStatus(resp.StatusCode) {
+			delay, ok := f.retryAfter(resp)
+			if !ok {
+				delay = f.backoff(attempt)
+			}
+
+			if delay <= f.opts.MaxDelay {
+				_, _ = io.Copy(ioutil.Discard, resp.Body)
+				_ = resp.Body.Close()
+				release()
+				if err := sleepContext(ctx, delay); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			// Server asked us to wait longer than we are willing to, give up
+		}
+
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+		return resp, nil
+	}
+}
+
+func (f *HTTPFetcher) acquireHost(ctx context.Context, host string) (func(), error) {
+	if f.opts.MaxPerHost <= 0 {
+		return func() {}, nil
+	}
+
+	f.mu.Lock()
+	sem, ok := f.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, f.opts.MaxPerHost)
+		f.hosts[host] = sem
+	}
+	f.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		var once sync.Once
+		return func() {
+			once.Do(func() {
+				<-sem
+			})
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// backoff returns an exponential backoff delay with full jitter.
+func (f *HTTPFetcher) backoff(attempt int) time.Duration {
+	delay := f.opts.BaseDelay << attempt
+	if delay <= 0 || delay > f.opts.MaxDelay {
+		delay = f.opts.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+func (f *HTTPFetcher) retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		delay := time.Until(t)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releasingBody releases a host slot once the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
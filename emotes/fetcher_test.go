@@ -0,0 +1,259 @@
+package emotes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedServer responds to each request with the next status of a script,
+// repeating the last one, and records when requests arrive.
+type scriptedServer struct {
+	*httptest.Server
+	statuses   []int
+	retryAfter string
+
+	times []time.Time
+	mu    sync.Mutex
+}
+
+func newScriptedServer(t *testing.T, retryAfter string, statuses ...int) *scriptedServer {
+	s := &scriptedServer{statuses: statuses, retryAfter: retryAfter}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		n := len(s.times)
+		s.times = append(s.times, time.Now())
+		s.mu.Unlock()
+
+		status := s.statuses[len(s.statuses)-1]
+		if n < len(s.statuses) {
+			status = s.statuses[n]
+		}
+		if status != http.StatusOK && s.retryAfter != "" {
+			w.Header().Set("Retry-After", s.retryAfter)
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(strconv.Itoa(n)))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *scriptedServer) requests() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.times...)
+}
+
+func testFetcherOptions() FetcherOptions {
+	return FetcherOptions{
+		Timeout:    time.Second * 5,
+		MaxRetries: 3,
+		BaseDelay:  time.Millisecond,
+		MaxDelay:   time.Millisecond * 10,
+	}
+}
+
+func fetch(t *testing.T, f *HTTPFetcher, ctx context.Context, url string) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := f.Do(req)
+	if err == nil {
+		t.Cleanup(func() { resp.Body.Close() })
+	}
+	return resp, err
+}
+
+func TestHTTPFetcherRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     int
+		requests int
+	}{
+		{"Success", []int{200}, 200, 1},
+		{"RetriesServerErrors", []int{500, 502, 503, 200}, 200, 4},
+		{"RetriesTooManyRequests", []int{429, 200}, 200, 2},
+		{"GivesUpAfterMaxRetries", []int{503}, 503, 4},
+		{"DoesNotRetryClientErrors", []int{404, 200}, 404, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newScriptedServer(t, "", tt.statuses...)
+			resp, err := fetch(t, NewHTTPFetcher(nil, testFetcherOptions()), context.Background(), server.URL)
+			if err != nil {
+				t.Fatalf("Do: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if n := len(server.requests()); n != tt.requests {
+				t.Errorf("made %d requests, want %d", n, tt.requests)
+			}
+		})
+	}
+}
+
+func TestHTTPFetcherRetriesTransportErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	start := time.Now()
+	_, err := fetch(t, NewHTTPFetcher(nil, testFetcherOptions()), context.Background(), url)
+	if err == nil {
+		t.Fatal("Do of closed server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v, want backoff of at most 3 * MaxDelay", elapsed)
+	}
+}
+
+func TestHTTPFetcherBackoff(t *testing.T) {
+	opts := testFetcherOptions()
+	opts.BaseDelay = time.Millisecond * 100
+	opts.MaxDelay = time.Second
+	f := NewHTTPFetcher(nil, opts)
+
+	for attempt, limit := range []time.Duration{
+		time.Millisecond * 100,
+		time.Millisecond * 200,
+		time.Millisecond * 400,
+		time.Millisecond * 800,
+		time.Second, // capped
+		time.Second,
+	} {
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			d := f.backoff(attempt)
+			if d < 0 || d > limit {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", attempt, d, limit)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 10 {
+			t.Errorf("backoff(%d) returned %d distinct delays, want jitter", attempt, len(seen))
+		}
+	}
+
+	// Shifting far enough to overflow still caps the delay
+	if d := f.backoff(80); d < 0 || d > opts.MaxDelay {
+		t.Errorf("backoff(80) = %v, want within [0, %v]", d, opts.MaxDelay)
+	}
+}
+
+func TestHTTPFetcherRetryAfter(t *testing.T) {
+	t.Run("Honored", func(t *testing.T) {
+		server := newScriptedServer(t, "1", 429, 200)
+		opts := testFetcherOptions()
+		opts.MaxDelay = time.Second * 2
+
+		resp, err := fetch(t, NewHTTPFetcher(nil, opts), context.Background(), server.URL)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("Do = %v, %v, want 200", resp, err)
+		}
+		times := server.requests()
+		if len(times) != 2 {
+			t.Fatalf("made %d requests, want 2", len(times))
+		}
+		if wait := times[1].Sub(times[0]); wait < time.Millisecond*900 {
+			t.Errorf("retried after %v, want the 1s from Retry-After", wait)
+		}
+	})
+
+	t.Run("Date", func(t *testing.T) {
+		server := newScriptedServer(t, time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 503, 200)
+		resp, err := fetch(t, NewHTTPFetcher(nil, testFetcherOptions()), context.Background(), server.URL)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("Do = %v, %v, want 200", resp, err)
+		}
+	})
+
+	t.Run("BeyondMaxDelay", func(t *testing.T) {
+		// Waiting longer than MaxDelay isn't worth it, the response is returned
+		server := newScriptedServer(t, "60", 429, 200)
+		start := time.Now()
+		resp, err := fetch(t, NewHTTPFetcher(nil, testFetcherOptions()), context.Background(), server.URL)
+		if err != nil || resp.StatusCode != 429 {
+			t.Fatalf("Do = %v, %v, want 429", resp, err)
+		}
+		if n := len(server.requests()); n != 1 {
+			t.Errorf("made %d requests, want 1", n)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("returned after %v, want no wait", elapsed)
+		}
+	})
+}
+
+func TestHTTPFetcherPerHostLimit(t *testing.T) {
+	server := newScriptedServer(t, "", 200)
+	opts := testFetcherOptions()
+	opts.MaxPerHost = 2
+	f := NewHTTPFetcher(nil, opts)
+
+	// Both slots are held until the response bodies are closed
+	first, err := fetch(t, f, context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if _, err := fetch(t, f, context.Background(), server.URL); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := fetch(t, f, ctx, server.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Do over the host limit = %v, want context.DeadlineExceeded", err)
+	}
+	if n := len(server.requests()); n != 2 {
+		t.Errorf("made %d requests, want 2", n)
+	}
+
+	// Other hosts aren't limited
+	other := newScriptedServer(t, "", 200)
+	if _, err := fetch(t, f, context.Background(), other.URL); err != nil {
+		t.Fatalf("Do of other host: %v", err)
+	}
+
+	// Closing a body frees its slot, closing it again doesn't free another
+	first.Body.Close()
+	first.Body.Close()
+	if _, err := fetch(t, f, context.Background(), server.URL); err != nil {
+		t.Fatalf("Do after closing a body: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := fetch(t, f, ctx, server.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Do over the host limit after a double close = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestHTTPFetcherCancel(t *testing.T) {
+	server := newScriptedServer(t, "", 503)
+	opts := testFetcherOptions()
+	opts.BaseDelay = time.Second * 10
+	opts.MaxDelay = time.Second * 10
+	opts.MaxRetries = 100
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+
+	start := time.Now()
+	_, err := fetch(t, NewHTTPFetcher(nil, opts), ctx, server.URL)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Do error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Do returned %v after cancellation, want immediately", elapsed)
+	}
+}
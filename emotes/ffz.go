@@ -1,17 +1,28 @@
 package emotes
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strconv"
 )
 
 const (
-	ffzGlobalEmotesEndpoint  = "https://api.frankerfacez.com/v1/set/global"
-	ffzChannelEmotesEndpoint = "https://api.frankerfacez.com/v1/room/id/%s"
-	ffzSpecificEmoteEndpoint = "https://api.frankerfacez.com/v1/emote/%s"
+	ffzDefaultAPIBase = "https://api.frankerfacez.com/v1"
+
+	ffzGlobalEmotesEndpoint  = "%s/set/global"
+	ffzChannelEmotesEndpoint = "%s/room/id/%s"
+	ffzSpecificEmoteEndpoint = "%s/emote/%s"
 )
 
+// FFZ modifier flags with an equivalent Modifiers value
+var ffzModifierFlags = map[int]Modifiers{
+	1 << 1: FlipHorizontal,
+	1 << 2: FlipVertical,
+	1 << 3: Wide,
+	1 << 8: RotateRight,
+}
+
 type FfzGlobal struct {
 	DefaultSets []int              `json:"default_sets"`
 	Sets        map[string]*FfzSet `json:"sets"`
@@ -44,14 +55,43 @@ type FfzEmote struct {
 	ID     int     `json:"id"`
 	Name   string  `json:"name"`
 	Images FfzUrls `json:"urls"`
+	// Modifier emotes change the emote before them instead of being shown
+	Modifier      bool `json:"modifier"`
+	ModifierFlags int  `json:"modifier_flags"`
+
+	cdnBase string
 }
 
 var _ Emote = &FfzEmote{}
+var _ ModifierEmote = &FfzEmote{}
+var _ ZeroWidthEmote = &FfzEmote{}
 
 func (f *FfzEmote) EmoteID() string {
 	return strconv.Itoa(f.ID)
 }
 
+func (f *FfzEmote) Modifiers() (Modifiers, bool) {
+	if !f.Modifier {
+		return 0, false
+	}
+
+	var m Modifiers
+	for flag, modifier := range ffzModifierFlags {
+		if f.ModifierFlags&flag != 0 {
+			m = m.Combine(modifier)
+		}
+	}
+	return m, m != 0
+}
+
+// ZeroWidth reports whether the emote is a modifier without a supported
+// transformation, such as the older modifier emotes which are just drawn
+// over the previous emote.
+func (f *FfzEmote) ZeroWidth() bool {
+	_, ok := f.Modifiers()
+	return f.Modifier && !ok
+}
+
 func (f *FfzEmote) TypedName() string {
 	return f.Name
 }
@@ -61,18 +101,18 @@ func (f *FfzEmote) LetterCode() string {
 }
 
 func (f *FfzEmote) Type() string {
-	return "png" // FFZ only supports pngs at the moment
+	return MimeTypePNG // FFZ only supports pngs at the moment
 }
 
-func GetGlobalFFZEmotes() ([]*FfzEmote, error) {
-	req, err := http.NewRequest("GET", ffzGlobalEmotesEndpoint, nil)
+func GetGlobalFFZEmotes(ctx context.Context, fetcher Fetcher, endpoints ProviderEndpoints) ([]*FfzEmote, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(ffzGlobalEmotesEndpoint, endpoints.APIBase), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	populateHeaders(req)
 
-	resp, err := client.Do(req)
+	resp, err := fetcher.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -92,22 +132,31 @@ func GetGlobalFFZEmotes() ([]*FfzEmote, error) {
 		emotes = append(emotes, set.Emoticons...)
 	}
 
+	for _, e := range emotes {
+		e.cdnBase = endpoints.CDNBase
+	}
+
 	return emotes, nil
 }
 
-func GetChannelFFZEmotes(channelID string) ([]*FfzEmote, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(ffzChannelEmotesEndpoint, channelID), nil)
+func GetChannelFFZEmotes(ctx context.Context, fetcher Fetcher, endpoints ProviderEndpoints, channelID string) ([]*FfzEmote, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(ffzChannelEmotesEndpoint, endpoints.APIBase, channelID), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	populateHeaders(req)
 
-	resp, err := client.Do(req)
+	resp, err := fetcher.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
+	if resp.StatusCode == http.StatusNotFound { // FFZ returns 404 if the channel has no FFZ room
+		_ = resp.Body.Close()
+		return []*FfzEmote{}, nil
+	}
+
 	var data FfzRoom
 	if err := unmarshalResponseBody(resp, &data); err != nil {
 		return nil, err
@@ -119,18 +168,22 @@ func GetChannelFFZEmotes(channelID string) ([]*FfzEmote, error) {
 		return nil, fmt.Errorf("FFZ returned room set of ID %q for room %q but didn't provide set", setIDAsString, data.RoomInfo.Set)
 	}
 
+	for _, e := range set.Emoticons {
+		e.cdnBase = endpoints.CDNBase
+	}
+
 	return set.Emoticons, nil
 }
 
-func GetSpecificFFZEmote(emoteID string) (*FfzEmote, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(ffzSpecificEmoteEndpoint, emoteID), nil)
+func GetSpecificFFZEmote(ctx context.Context, fetcher Fetcher, endpoints ProviderEndpoints, emoteID string) (*FfzEmote, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(ffzSpecificEmoteEndpoint, endpoints.APIBase, emoteID), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	populateHeaders(req)
 
-	resp, err := client.Do(req)
+	resp, err := fetcher.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -140,5 +193,6 @@ func GetSpecificFFZEmote(emoteID string) (*FfzEmote, error) {
 		return nil, err
 	}
 
+	data.Emote.cdnBase = endpoints.CDNBase
 	return &data.Emote, nil
 }
@@ -0,0 +1,496 @@
+package emotes
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tempFilePrefix = ".tmp-"
+	checksumExt    = ".sha256"
+	quarantineDir  = "quarantine"
+)
+
+// EvictionStats describes the outcome of an eviction pass.
+type EvictionStats struct {
+	Expired        int
+	Evicted        int
+	FreedBytes     int64
+	RemainingFiles int
+	RemainingBytes int64
+}
+
+// ImageFileCache is a BlobStore that keeps images as files on disk.
+//
+// Files are spread over shard directories named after the first byte of the
+// hash of their key, and the index is persisted to a manifest file. Files are
+// removed once they are older than expiration, and the least recently used
+// files are removed when the cache grows beyond maxBytes.
+//
+// Apart from Index, which runs before the cache is used, files are never read,
+// written or removed while the index lock is held.
+type ImageFileCache struct {
+	cacheMap   map[string]*list.Element
+	order      *list.List // front is most recently used
+	basePath   string
+	expiration time.Duration
+	// Maximum total size of cached files, or zero for unlimited
+	maxBytes  int64
+	usedBytes int64
+	// Remove files older than expiration in the basePath directory
+	cleanOnIndex bool
+	// Whether cacheMap changed since the manifest was last saved
+	dirty bool
+
+	mu     sync.Mutex
+	saveMu sync.Mutex
+}
+
+type cachedFile struct {
+	key   string
+	entry manifestEntry
+}
+
+var _ BlobStore = &ImageFileCache{}
+var _ BlobModTimer = &ImageFileCache{}
+var _ BlobChecksummer = &ImageFileCache{}
+
+func NewImageFileCache(basePath string, expiration time.Duration, maxBytes int64, cleanOnIndex bool) *ImageFileCache {
+	return &ImageFileCache{
+		cacheMap:     make(map[string]*list.Element),
+		order:        list.New(),
+		basePath:     basePath,
+		expiration:   expiration,
+		maxBytes:     maxBytes,
+		cleanOnIndex: cleanOnIndex,
+	}
+}
+
+// Index loads the cache index from the manifest, adding any files written
+// since it was last saved, or rebuilds it from the files on disk if there is no
+// usable manifest.
+func (c *ImageFileCache) Index() error {
+	c.mu.Lock()
+	manifest, err := c.loadManifest()
+	if err != nil {
+		log.Printf("Ignoring image cache manifest: %v\n", err)
+	}
+
+	if manifest != nil {
+		err = c.indexManifest(manifest)
+		if err == nil {
+			err = c.indexUnlisted()
+		}
+	} else {
+		err = c.rebuildIndex()
+	}
+	c.sortByAccess()
+	c.dirty = true
+	c.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("cache index: %w", err)
+	}
+	return c.SaveManifest()
+}
+
+// Evict removes expired files, then the least recently used files until the
+// cache fits in its size budget.
+func (c *ImageFileCache) Evict() (EvictionStats, error) {
+	var stats EvictionStats
+	var victims []manifestEntry
+
+	c.mu.Lock()
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		if f := el.Value.(*cachedFile); time.Since(f.entry.Created) > c.expiration {
+			victims = append(victims, c.unlink(el))
+			stats.Expired++
+			stats.FreedBytes += f.entry.Size
+		}
+		el = prev
+	}
+
+	evicted := c.victimsOverBudget()
+	for _, entry := range evicted {
+		stats.FreedBytes += entry.Size
+	}
+	stats.Evicted = len(evicted)
+	stats.RemainingFiles = len(c.cacheMap)
+	stats.RemainingBytes = c.usedBytes
+	c.mu.Unlock()
+
+	victims = append(victims, evicted...)
+	return stats, c.removeFiles(victims)
+}
+
+// victimsOverBudget unlinks the least recently used files until the cache fits
+// in maxBytes, returning them so they can be removed. c.mu must be held.
+func (c *ImageFileCache) victimsOverBudget() []manifestEntry {
+	if c.maxBytes <= 0 {
+		return nil
+	}
+
+	var victims []manifestEntry
+	for c.usedBytes > c.maxBytes && c.order.Len() > 0 {
+		victims = append(victims, c.unlink(c.order.Back()))
+	}
+	return victims
+}
+
+// unlink removes a file from the index without removing it from disk, and
+// returns its entry. c.mu must be held.
+func (c *ImageFileCache) unlink(el *list.Element) manifestEntry {
+	f := c.order.Remove(el).(*cachedFile)
+	delete(c.cacheMap, f.key)
+	c.usedBytes -= f.entry.Size
+	c.dirty = true
+	return f.entry
+}
+
+// link adds a file to the index as the most recently used one, replacing any
+// previous entry of key, which is returned. c.mu must be held.
+func (c *ImageFileCache) link(key string, entry manifestEntry) (manifestEntry, bool) {
+	var previous manifestEntry
+	el, replaced := c.cacheMap[key]
+	if replaced {
+		previous = c.unlink(el)
+	}
+
+	c.cacheMap[key] = c.order.PushFront(&cachedFile{
+		key:   key,
+		entry: entry,
+	})
+	c.usedBytes += entry.Size
+	c.dirty = true
+	return previous, replaced
+}
+
+// lookup returns the entry of key. c.mu must be held.
+func (c *ImageFileCache) lookup(key string) (manifestEntry, bool) {
+	el, ok := c.cacheMap[key]
+	if !ok {
+		return manifestEntry{}, false
+	}
+	return el.Value.(*cachedFile).entry, true
+}
+
+// sortByAccess orders the index by the recorded access times of its files,
+// which are indexed in no particular order. c.mu must be held.
+func (c *ImageFileCache) sortByAccess() {
+	files := make([]*cachedFile, 0, c.order.Len())
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		files = append(files, el.Value.(*cachedFile))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].entry.Accessed.After(files[j].entry.Accessed)
+	})
+
+	c.order.Init()
+	for _, f := range files {
+		c.cacheMap[f.key] = c.order.PushBack(f)
+	}
+}
+
+// removeFiles removes files that were unlinked from the index, returning the
+// first error after trying all of them.
+func (c *ImageFileCache) removeFiles(entries []manifestEntry) error {
+	var firstErr error
+	for _, entry := range entries {
+		if err := removeCachedFile(c.entryPath(entry)); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("remove %q: %w", entry.Path, err)
+		}
+	}
+	return firstErr
+}
+
+func (c *ImageFileCache) Purge() error {
+	c.mu.Lock()
+	victims := make([]manifestEntry, 0, c.order.Len())
+	for c.order.Len() > 0 {
+		victims = append(victims, c.unlink(c.order.Back()))
+	}
+	c.mu.Unlock()
+
+	if err := c.removeFiles(victims); err != nil {
+		return fmt.Errorf("purge: %w", err)
+	}
+	return c.SaveManifest()
+}
+
+// AutoEvict runs Evict and saves the manifest every interval until ctx is
+// done, then saves the manifest a final time. A non-positive interval disables
+// periodic eviction.
+func (c *ImageFileCache) AutoEvict(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			stats, err := c.Evict()
+			if err != nil {
+				log.Printf("AutoEvict: %v\n", err)
+			}
+			if stats.Expired > 0 || stats.Evicted > 0 {
+				log.Printf("AutoEvict: removed %d expired and %d least recently used files (%d bytes), %d files (%d bytes) remain\n",
+					stats.Expired, stats.Evicted, stats.FreedBytes, stats.RemainingFiles, stats.RemainingBytes)
+			}
+			if err := c.SaveManifest(); err != nil {
+				log.Printf("AutoEvict: %v\n", err)
+			}
+		case <-ctx.Done():
+			if err := c.SaveManifest(); err != nil {
+				log.Printf("AutoEvict: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+func (c *ImageFileCache) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	el, exists := c.cacheMap[key]
+	var entry manifestEntry
+	if exists {
+		f := el.Value.(*cachedFile)
+		f.entry.Accessed = time.Now()
+		entry = f.entry
+		c.order.MoveToFront(el)
+		c.dirty = true
+	}
+	c.mu.Unlock()
+	if !exists {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(c.entryPath(entry))
+	if os.IsNotExist(err) { // evicted since we looked it up, or removed behind our back
+		c.unlinkIfCurrent(key, entry)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if checksum(data) != entry.Checksum {
+		if c.unlinkIfCurrent(key, entry) {
+			log.Printf("Quarantining cached image %q: checksum mismatch\n", key)
+			if err := c.quarantine(c.entryPath(entry)); err != nil {
+				log.Printf("Quarantine %q: %v\n", key, err)
+			}
+		}
+		return nil, nil
+	}
+	return data, nil
+}
+
+// unlinkIfCurrent removes key from the index unless its file was replaced
+// since entry was looked up, reporting whether it did.
+func (c *ImageFileCache) unlinkIfCurrent(key string, entry manifestEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.cacheMap[key]
+	if !ok || el.Value.(*cachedFile).entry.Checksum != entry.Checksum {
+		return false
+	}
+	c.unlink(el)
+	return true
+}
+
+func (c *ImageFileCache) Has(key string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, exists := c.cacheMap[key]
+	return exists, nil
+}
+
+func (c *ImageFileCache) ModTime(key string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.lookup(key)
+	return entry.Created, exists
+}
+
+func (c *ImageFileCache) Checksum(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.lookup(key)
+	return entry.Checksum, exists
+}
+
+func (c *ImageFileCache) Put(key string, data []byte) error {
+	entry := c.newEntry(key, data, time.Now())
+	if err := c.writeDataToCache(entry, data); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	var victims []manifestEntry
+	if previous, ok := c.link(key, entry); ok && previous.Path != entry.Path {
+		victims = append(victims, previous)
+	}
+	victims = append(victims, c.victimsOverBudget()...)
+	c.mu.Unlock()
+
+	if err := c.removeFiles(victims); err != nil {
+		log.Printf("Evict to budget: %v\n", err)
+	}
+	return nil
+}
+
+func (c *ImageFileCache) newEntry(key string, data []byte, created time.Time) manifestEntry {
+	contentType := http.DetectContentType(data)
+	return manifestEntry{
+		Path:        shardPath(key, contentType),
+		Created:     created,
+		Accessed:    created,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Checksum:    checksum(data),
+	}
+}
+
+func (c *ImageFileCache) entryPath(entry manifestEntry) string {
+	return filepath.Join(c.basePath, entry.Path)
+}
+
+// shardPath returns the path of a cached file relative to the cache base path.
+func shardPath(key, contentType string) string {
+	ext := ".png"
+	if contentType == "image/gif" {
+		ext = ".gif"
+	}
+	return filepath.Join(hashString(key)[:2], key+ext)
+}
+
+func (c *ImageFileCache) quarantinePath() string {
+	return filepath.Join(c.basePath, quarantineDir)
+}
+
+// quarantine moves a corrupt cached file and its checksum out of the cache so
+// it can be inspected later.
+func (c *ImageFileCache) quarantine(fPath string) error {
+	dir := c.quarantinePath()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	name := filepath.Base(fPath)
+	if err := os.Rename(fPath, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	if err := os.Rename(checksumPath(fPath), filepath.Join(dir, name+checksumExt)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *ImageFileCache) writeDataToCache(entry manifestEntry, data []byte) error {
+	fPath := c.entryPath(entry)
+	if err := os.MkdirAll(filepath.Dir(fPath), 0755); err != nil {
+		return fmt.Errorf("create shard directory: %w", err)
+	}
+	if err := writeFileAtomic(fPath, data); err != nil {
+		return fmt.Errorf("write cache file: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to fPath and renames it
+// into place, so readers never see a partially written file.
+func writeFileAtomic(fPath string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(fPath), tempFilePrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, fPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// removeCachedFile removes a cached file along with its checksum sidecar, if
+// it was written before checksums moved to the manifest.
+func removeCachedFile(fPath string) error {
+	if err := os.Remove(fPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(checksumPath(fPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// verifyCachedFile reads a cached file that isn't in the manifest and checks
+// it against its checksum sidecar. Files without a sidecar must decode as an
+// image.
+func verifyCachedFile(fPath string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fPath)
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := ioutil.ReadFile(checksumPath(fPath))
+	if os.IsNotExist(err) {
+		if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+		return data, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read checksum: %w", err)
+	}
+
+	if strings.TrimSpace(string(expected)) != checksum(data) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return data, nil
+}
+
+func checksumPath(fPath string) string {
+	return fPath + checksumExt
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
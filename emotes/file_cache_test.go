@@ -0,0 +1,185 @@
+package emotes
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testBlob(n int, fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, n)
+}
+
+func TestImageFileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewImageFileCache(t.TempDir(), time.Hour, 300, false)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Put(key, testBlob(100, key[0])); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+	if data, err := c.Get("a"); err != nil || data == nil {
+		t.Fatalf("Get(a) = %v, %v", data, err)
+	}
+
+	// "b" is now the least recently used
+	if err := c.Put("d", testBlob(100, 'd')); err != nil {
+		t.Fatalf("Put(d): %v", err)
+	}
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if ok, _ := c.Has(key); ok != want {
+			t.Errorf("Has(%q) = %v, want %v", key, ok, want)
+		}
+	}
+
+	c.mu.Lock()
+	entry := manifestEntry{Path: shardPath("b", "text/plain; charset=utf-8")}
+	used := c.usedBytes
+	c.mu.Unlock()
+	if _, err := os.Stat(c.entryPath(entry)); !os.IsNotExist(err) {
+		t.Errorf("evicted file still exists: %v", err)
+	}
+	if used != 300 {
+		t.Errorf("used bytes = %d, want 300", used)
+	}
+}
+
+func TestImageFileCacheEvictExpired(t *testing.T) {
+	c := NewImageFileCache(t.TempDir(), time.Hour, 0, false)
+	if err := c.Put("fresh", testBlob(10, 'f')); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := c.Put("stale", testBlob(10, 's')); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	c.mu.Lock()
+	c.cacheMap["stale"].Value.(*cachedFile).entry.Created = time.Now().Add(-time.Hour * 2)
+	c.mu.Unlock()
+
+	stats, err := c.Evict()
+	if err != nil {
+		t.Fatalf("Evict: %v", err)
+	}
+	if stats.Expired != 1 || stats.Evicted != 0 || stats.RemainingFiles != 1 || stats.FreedBytes != 10 {
+		t.Errorf("stats = %+v, want 1 expired file of 10 bytes and 1 remaining", stats)
+	}
+	if ok, _ := c.Has("stale"); ok {
+		t.Error("expired file is still cached")
+	}
+}
+
+func TestImageFileCacheManifestKeepsAccessOrder(t *testing.T) {
+	dir := t.TempDir()
+	c := NewImageFileCache(dir, time.Hour, 0, false)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Put(key, testBlob(100, key[0])); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := c.Get("a"); err != nil {
+		t.Fatalf("Get(a): %v", err)
+	}
+	if err := c.SaveManifest(); err != nil {
+		t.Fatalf("SaveManifest: %v", err)
+	}
+
+	restored := NewImageFileCache(dir, time.Hour, 250, false)
+	if err := restored.Index(); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	// Over budget, so the next Put evicts the least recently used files
+	if err := restored.Put("d", testBlob(100, 'd')); err != nil {
+		t.Fatalf("Put(d): %v", err)
+	}
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": false, "d": true} {
+		if ok, _ := restored.Has(key); ok != want {
+			t.Errorf("Has(%q) = %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestImageFileCacheConcurrent(t *testing.T) {
+	c := NewImageFileCache(t.TempDir(), time.Hour, 2000, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("k%d", (i+j)%40)
+				if err := c.Put(key, testBlob(100, byte(j))); err != nil {
+					t.Errorf("Put(%q): %v", key, err)
+				}
+				if _, err := c.Get(key); err != nil {
+					t.Errorf("Get(%q): %v", key, err)
+				}
+				if j%10 == 0 {
+					if _, err := c.Evict(); err != nil {
+						t.Errorf("Evict: %v", err)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.usedBytes > 2000 || c.usedBytes != int64(c.order.Len())*100 {
+		t.Errorf("used bytes = %d for %d files, want at most 2000", c.usedBytes, c.order.Len())
+	}
+}
+
+func TestImageFileCacheIndexesFilesMissingFromManifest(t *testing.T) {
+	dir := t.TempDir()
+	c := NewImageFileCache(dir, time.Hour, 0, false)
+	if err := c.Put("saved", testBlob(100, 's')); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := c.SaveManifest(); err != nil {
+		t.Fatalf("SaveManifest: %v", err)
+	}
+
+	// Written after the last save, as if the process crashed before the next one
+	png := encodeTestPNG(t, 4, 4)
+	if err := c.Put("unsaved", png); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	restored := NewImageFileCache(dir, time.Hour, 0, false)
+	if err := restored.Index(); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	for _, key := range []string{"saved", "unsaved"} {
+		if ok, _ := restored.Has(key); !ok {
+			t.Errorf("Has(%q) = false after indexing", key)
+		}
+	}
+	if data, err := restored.Get("unsaved"); err != nil || !bytes.Equal(data, png) {
+		t.Errorf("Get(unsaved) = %d bytes, %v, want the written file", len(data), err)
+	}
+
+	restored.mu.Lock()
+	used := restored.usedBytes
+	restored.mu.Unlock()
+	if want := int64(100 + len(png)); used != want {
+		t.Errorf("used bytes = %d, want %d", used, want)
+	}
+
+	// The unlisted file is now in the manifest
+	manifest, err := restored.loadManifest()
+	if err != nil {
+		t.Fatalf("loadManifest: %v", err)
+	}
+	if _, ok := manifest.Entries["unsaved"]; !ok {
+		t.Error("unlisted file wasn't added to the manifest")
+	}
+}
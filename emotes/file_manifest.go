@@ -0,0 +1,252 @@
+package emotes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	manifestFile    = "manifest.json"
+	manifestVersion = 1
+)
+
+// fileManifest is the persisted index of an ImageFileCache, so that startup
+// doesn't need to walk and stat every cached file.
+type fileManifest struct {
+	Version int                      `json:"version"`
+	Entries map[string]manifestEntry `json:"entries"`
+}
+
+type manifestEntry struct {
+	// Path relative to the cache base path
+	Path        string    `json:"path"`
+	Created     time.Time `json:"created"`
+	Accessed    time.Time `json:"accessed"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Checksum    string    `json:"checksum"`
+}
+
+func (c *ImageFileCache) manifestPath() string {
+	return filepath.Join(c.basePath, manifestFile)
+}
+
+// loadManifest reads the manifest from disk, returning nil if there is none.
+func (c *ImageFileCache) loadManifest() (*fileManifest, error) {
+	data, err := ioutil.ReadFile(c.manifestPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+
+	var manifest fileManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", manifest.Version)
+	}
+	return &manifest, nil
+}
+
+// SaveManifest writes the cache index to disk if it changed since the last
+// save.
+func (c *ImageFileCache) SaveManifest() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	manifest := fileManifest{
+		Version: manifestVersion,
+		Entries: make(map[string]manifestEntry, len(c.cacheMap)),
+	}
+	for key, el := range c.cacheMap {
+		manifest.Entries[key] = el.Value.(*cachedFile).entry
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	data, err := json.Marshal(&manifest)
+	if err != nil {
+		return fmt.Errorf("encode manifest: %w", err)
+	}
+	if err := writeFileAtomic(c.manifestPath(), data); err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	return nil
+}
+
+// indexManifest populates the cache from a previously saved manifest. Entries
+// whose file is missing are dropped and entries whose file size changed are
+// quarantined. Checksums are verified when a file is read. c.mu must be held.
+func (c *ImageFileCache) indexManifest(manifest *fileManifest) error {
+	quarantined := 0
+	for key, entry := range manifest.Entries {
+		fPath := c.entryPath(entry)
+		if time.Since(entry.Created) > c.expiration {
+			if c.cleanOnIndex {
+				if err := removeCachedFile(fPath); err != nil {
+					return fmt.Errorf("remove %q: %w", key, err)
+				}
+			}
+			continue
+		}
+
+		info, err := os.Stat(fPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("stat %q: %w", key, err)
+		}
+
+		if info.Size() != entry.Size {
+			log.Printf("Quarantining cached image %q: size mismatch\n", key)
+			if err := c.quarantine(fPath); err != nil {
+				return fmt.Errorf("quarantine %q: %w", key, err)
+			}
+			quarantined++
+			continue
+		}
+
+		c.link(key, entry)
+	}
+
+	if quarantined > 0 {
+		log.Printf("Quarantined %d corrupt cached images in %s\n", quarantined, c.quarantinePath())
+	}
+	return nil
+}
+
+// rebuildIndex walks the cache directory to rebuild the index when there is no
+// usable manifest. c.mu must be held.
+func (c *ImageFileCache) rebuildIndex() error {
+	stats, err := c.indexFiles()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rebuilt image cache index: %d images (%d moved to shard directories), %d quarantined\n", stats.indexed, stats.moved, stats.quarantined)
+	return nil
+}
+
+// indexUnlisted adds the files that are missing from the manifest, such as
+// those written after it was last saved by a process that crashed. c.mu must
+// be held.
+func (c *ImageFileCache) indexUnlisted() error {
+	stats, err := c.indexFiles()
+	if err != nil {
+		return err
+	}
+
+	if stats.indexed > 0 || stats.quarantined > 0 {
+		log.Printf("Indexed %d cached images missing from the manifest, %d quarantined\n", stats.indexed, stats.quarantined)
+	}
+	return nil
+}
+
+type indexStats struct {
+	indexed, moved, quarantined int
+}
+
+// indexFiles walks the cache directory and indexes the files that aren't
+// indexed yet. Each of them is verified, and files that aren't in their shard
+// directory, such as those written by the flat layout used before the manifest
+// existed, are moved there. Indexed files are only listed, not read. c.mu must
+// be held.
+func (c *ImageFileCache) indexFiles() (indexStats, error) {
+	var stats indexStats
+	err := filepath.WalkDir(c.basePath, func(fPath string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			// moved after the directory was listed
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if fPath == c.quarantinePath() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), tempFilePrefix) {
+			// left behind by an interrupted write
+			if err := os.Remove(fPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("remove temp file %q: %w", d.Name(), err)
+			}
+			return nil
+		}
+
+		ext := filepath.Ext(fPath)
+		if ext != ".png" && ext != ".gif" {
+			return nil
+		}
+
+		key := strings.TrimSuffix(d.Name(), ext)
+		if _, ok := c.cacheMap[key]; ok {
+			// listed in the manifest, or moved here earlier in the walk
+			return nil
+		}
+
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if time.Since(info.ModTime()) > c.expiration {
+			if c.cleanOnIndex {
+				if err := removeCachedFile(fPath); err != nil {
+					return fmt.Errorf("remove %q: %w", key, err)
+				}
+			}
+			return nil
+		}
+
+		data, err := verifyCachedFile(fPath)
+		if err != nil {
+			log.Printf("Quarantining cached image %q: %v\n", key, err)
+			if err := c.quarantine(fPath); err != nil {
+				return fmt.Errorf("quarantine %q: %w", key, err)
+			}
+			stats.quarantined++
+			return nil
+		}
+
+		entry := c.newEntry(key, data, info.ModTime())
+		if newPath := c.entryPath(entry); newPath != fPath {
+			if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+				return fmt.Errorf("create shard directory: %w", err)
+			}
+			if err := os.Rename(fPath, newPath); err != nil {
+				return fmt.Errorf("move %q: %w", key, err)
+			}
+			stats.moved++
+		}
+		if err := os.Remove(checksumPath(fPath)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove checksum %q: %w", key, err)
+		}
+
+		c.link(key, entry)
+		stats.indexed++
+		return nil
+	})
+	return stats, err
+}
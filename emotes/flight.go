@@ -0,0 +1,69 @@
+package emotes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// flightGroup deduplicates concurrent calls that share a key, similar to
+// golang.org/x/sync/singleflight.
+type flightGroup[T any] struct {
+	calls map[string]*flightCall[T]
+	mu    sync.Mutex
+}
+
+type flightCall[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+}
+
+func newFlightGroup[T any]() *flightGroup[T] {
+	return &flightGroup[T]{
+		calls: make(map[string]*flightCall[T]),
+	}
+}
+
+// Do runs fn once for all concurrent callers with the same key. fn runs in
+// its own goroutine so that a caller giving up because ctx is done does not
+// cancel the work for other callers.
+func (g *flightGroup[T]) Do(ctx context.Context, key string, fn func() (T, error)) (T, error) {
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if !ok {
+		call = &flightCall[T]{
+			done: make(chan struct{}),
+		}
+		g.calls[key] = call
+
+		go func() {
+			defer func() {
+				// Nothing else recovers panics in this goroutine, such as
+				// those caused by malformed images, so they would crash the server
+				if r := recover(); r != nil {
+					log.Printf("Recovered panic for %q: %v\n%s", key, r, debug.Stack())
+					call.err = fmt.Errorf("panic: %v", r)
+				}
+
+				g.mu.Lock()
+				delete(g.calls, key)
+				g.mu.Unlock()
+				close(call.done)
+			}()
+
+			call.val, call.err = fn()
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
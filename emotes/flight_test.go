@@ -0,0 +1,34 @@
+package emotes
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestFlightGroupRecoversPanic(t *testing.T) {
+	g := newFlightGroup[int]()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := g.Do(context.Background(), "key", func() (int, error) {
+				panic("malformed image")
+			})
+			if err == nil {
+				t.Error("Do returned no error for a panicking call")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The key must be usable again
+	v, err := g.Do(context.Background(), "key", func() (int, error) {
+		return 42, nil
+	})
+	if err != nil || v != 42 {
+		t.Errorf("Do after panic = %d, %v, want 42, nil", v, err)
+	}
+}
@@ -0,0 +1,184 @@
+package emotes
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/png"
+	"mime"
+	"strings"
+)
+
+// Normalized MIME types of emote images.
+const (
+	MimeTypePNG  = "image/png"
+	MimeTypeGIF  = "image/gif"
+	MimeTypeWebP = "image/webp"
+	MimeTypeAVIF = "image/avif"
+)
+
+// imageFormat describes how images of one MIME type are decoded and encoded.
+// Any of the functions may be nil if the format doesn't support it.
+type imageFormat struct {
+	mimeType string
+	// Other names providers use for the type, such as "png"
+	aliases []string
+	// Whether images of this type can be animated
+	animated bool
+
+	// decode decodes an image, keeping every frame of an animation if
+	// animated is set and selecting a single frame otherwise.
+	decode       func(emote Emote, data []byte, animated bool) (*animation, error)
+	decodeConfig func(data []byte) (image.Config, error)
+	encode       func(anim *animation) ([]byte, error)
+}
+
+var (
+	formats       = make(map[string]*imageFormat)
+	formatAliases = make(map[string]string)
+)
+
+func init() {
+	registerFormat(&imageFormat{
+		mimeType: MimeTypePNG,
+		aliases:  []string{"png"},
+		decode: func(_ Emote, data []byte, _ bool) (*animation, error) {
+			img, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			return staticAnimation(img), nil
+		},
+		decodeConfig: func(data []byte) (image.Config, error) {
+			return png.DecodeConfig(bytes.NewReader(data))
+		},
+		encode: func(anim *animation) ([]byte, error) {
+			buf := new(bytes.Buffer)
+			if err := png.Encode(buf, anim.frames[0]); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+	})
+
+	registerFormat(&imageFormat{
+		mimeType: MimeTypeGIF,
+		aliases:  []string{"gif"},
+		animated: true,
+		decode: func(emote Emote, data []byte, animated bool) (*animation, error) {
+			g, err := gif.DecodeAll(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			if animated {
+				return coalesceGif(g, len(g.Image)-1)
+			}
+
+			frame, err := selectGifFrame(emote, g)
+			if err != nil {
+				return nil, err
+			}
+			return staticAnimation(frame), nil
+		},
+		decodeConfig: func(data []byte) (image.Config, error) {
+			return gif.DecodeConfig(bytes.NewReader(data))
+		},
+		encode: encodeGif,
+	})
+
+	registerFormat(&imageFormat{
+		mimeType: MimeTypeWebP,
+		aliases:  []string{"webp"},
+		animated: true,
+		decode: func(_ Emote, data []byte, animated bool) (*animation, error) {
+			return decodeWebP(data, animated)
+		},
+		decodeConfig: decodeWebPConfig,
+	})
+
+	// There is no AVIF decoder, so AVIF emotes are only measured and are
+	// otherwise redirected to their provider's CDN
+	registerFormat(&imageFormat{
+		mimeType:     MimeTypeAVIF,
+		aliases:      []string{"avif"},
+		decodeConfig: decodeAVIFConfig,
+	})
+}
+
+func registerFormat(f *imageFormat) {
+	formats[f.mimeType] = f
+	for _, alias := range f.aliases {
+		formatAliases[alias] = f.mimeType
+	}
+}
+
+// NormalizeMimeType converts the image type reported by a provider, such as
+// "png" or "image/PNG", to a lowercase MIME type without parameters.
+func NormalizeMimeType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	if mediaType, _, err := mime.ParseMediaType(t); err == nil {
+		t = mediaType
+	}
+
+	if normalized, ok := formatAliases[t]; ok {
+		return normalized
+	}
+	if t != "" && !strings.Contains(t, "/") {
+		return "image/" + t
+	}
+	return t
+}
+
+// IsAnimatedType reports whether images of the MIME type can be animated.
+func IsAnimatedType(t string) bool {
+	f := lookupFormat(t)
+	return f != nil && f.animated
+}
+
+func lookupFormat(t string) *imageFormat {
+	return formats[NormalizeMimeType(t)]
+}
+
+// canDecode reports whether images of the MIME type can be decoded.
+func (f *imageFormat) canDecode() bool {
+	return f.decode != nil
+}
+
+// decodeImage decodes an emote image of the given type.
+func decodeImage(emote Emote, t string, data []byte, animated bool) (*animation, error) {
+	f := lookupFormat(t)
+	if f == nil || !f.canDecode() {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedFormat, t)
+	}
+
+	anim, err := f.decode(emote, data, animated && f.animated)
+	if err != nil {
+		return nil, withKind(ErrDecode, err)
+	}
+	return anim, nil
+}
+
+// decodeImageConfig returns the dimensions of an image of the given type.
+func decodeImageConfig(t string, data []byte) (image.Config, error) {
+	f := lookupFormat(t)
+	if f == nil || f.decodeConfig == nil {
+		return image.Config{}, fmt.Errorf("%w %q", ErrUnsupportedFormat, t)
+	}
+
+	cfg, err := f.decodeConfig(data)
+	if err != nil {
+		return image.Config{}, withKind(ErrDecode, err)
+	}
+	return cfg, nil
+}
+
+// encodeAnimation encodes a processed image as an animated GIF if it has
+// several frames and as a PNG otherwise.
+func encodeAnimation(anim *animation) ([]byte, error) {
+	t := MimeTypePNG
+	if anim.animated() {
+		t = MimeTypeGIF
+	}
+	return formats[t].encode(anim)
+}
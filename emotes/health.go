@@ -0,0 +1,114 @@
+package emotes
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	providerRetryBaseDelay = time.Second * 30
+	providerRetryMaxDelay  = time.Minute * 10
+)
+
+// ProviderHealth describes the recent request outcomes of a provider.
+type ProviderHealth struct {
+	Provider            string    `json:"provider"`
+	Healthy             bool      `json:"healthy"`
+	GlobalsLoaded       bool      `json:"globals_loaded"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastFailure         time.Time `json:"last_failure"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+type healthTracker struct {
+	providers map[rune]*ProviderHealth
+	mu        sync.Mutex
+}
+
+func newHealthTracker(providers []Provider) *healthTracker {
+	t := &healthTracker{
+		providers: make(map[rune]*ProviderHealth),
+	}
+	for _, p := range providers {
+		t.providers[p.IdentifierCode()] = &ProviderHealth{
+			Provider: string(p.IdentifierCode()),
+		}
+	}
+	return t
+}
+
+func (t *healthTracker) record(identifierCode rune, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.providers[identifierCode]
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		h.Healthy = false
+		h.ConsecutiveFailures++
+		h.LastFailure = time.Now()
+		h.LastError = err.Error()
+	} else {
+		h.Healthy = true
+		h.ConsecutiveFailures = 0
+		h.LastSuccess = time.Now()
+	}
+}
+
+func (t *healthTracker) setGlobalsLoaded(identifierCode rune) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if h, ok := t.providers[identifierCode]; ok {
+		h.GlobalsLoaded = true
+	}
+}
+
+func (t *healthTracker) snapshot() []ProviderHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := make([]ProviderHealth, 0, len(t.providers))
+	for _, h := range t.providers {
+		res = append(res, *h)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Provider < res[j].Provider
+	})
+	return res
+}
+
+// providerFailure records a provider that failed to load for a channel.
+type providerFailure struct {
+	count   int
+	retryAt time.Time
+}
+
+func newProviderFailure(previous *providerFailure) *providerFailure {
+	count := 1
+	if previous != nil {
+		count = previous.count + 1
+	}
+
+	return &providerFailure{
+		count:   count,
+		retryAt: time.Now().Add(providerRetryDelay(count)),
+	}
+}
+
+// providerRetryDelay returns an exponential delay for the nth consecutive failure.
+func providerRetryDelay(failures int) time.Duration {
+	delay := providerRetryBaseDelay
+	for i := 1; i < failures && delay < providerRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > providerRetryMaxDelay {
+		delay = providerRetryMaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,412 @@
+package emotes
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ImageCache serves processed emote images, downloading them on a miss.
+type ImageCache interface {
+	// Animated emotes are processed into animated images if animated is set,
+	// and into a single frame otherwise.
+	GetCachedOrDownload(ctx context.Context, emote Emote, size ImageSize, animated bool) (*Image, error)
+	GetCachedOrDownloadTile(ctx context.Context, emote Emote, size ImageSize, tile Tile, animated bool) (*Image, error)
+	// GetCachedOrDownloadOverlay returns the image of a base emote with
+	// zero-width emotes drawn over it.
+	GetCachedOrDownloadOverlay(ctx context.Context, base Emote, overlays []Emote, size ImageSize, animated bool) (*Image, error)
+	// GetCachedOrDownloadModified returns the image of an emote with modifiers
+	// applied.
+	GetCachedOrDownloadModified(ctx context.Context, emote Emote, size ImageSize, m Modifiers, animated bool) (*Image, error)
+	DownloadToCache(ctx context.Context, emote Emote, size ImageSize, animated bool) error
+	DownloadModifiedToCache(ctx context.Context, emote Emote, size ImageSize, m Modifiers, animated bool) error
+	DownloadOverlayToCache(ctx context.Context, base Emote, overlays []Emote, size ImageSize, animated bool) error
+	// DownloadVirtualToCache stores all count tiles of an emote.
+	DownloadVirtualToCache(ctx context.Context, emote Emote, size ImageSize, count int, animated bool) error
+	GetEmoteAspectRatio(ctx context.Context, emote Emote) (float64, error)
+	Purge() error
+}
+
+// BlobStore is a storage backend for processed emote images.
+type BlobStore interface {
+	// Get returns the data stored under key, or nil if there is none.
+	Get(key string) ([]byte, error)
+	Has(key string) (bool, error)
+	Put(key string, data []byte) error
+	Purge() error
+}
+
+// BlobModTimer is implemented by BlobStores that record when a blob was
+// stored.
+type BlobModTimer interface {
+	ModTime(key string) (time.Time, bool)
+}
+
+// BlobChecksummer is implemented by BlobStores that record the hex SHA-256
+// checksum of each blob when it is stored.
+type BlobChecksummer interface {
+	Checksum(key string) (string, bool)
+}
+
+// Image is a processed emote image along with the metadata needed to serve it.
+type Image struct {
+	Data        []byte
+	ContentType string
+	// Strong entity tag derived from Data
+	ETag string
+	// When the image was stored, or zero if unknown
+	ModTime time.Time
+}
+
+const imageDownloadTimeout = time.Second * 30
+
+// BlobImageCache is an ImageCache that keeps processed images in a BlobStore.
+//
+// Concurrent requests for the same image share a single download, and no lock
+// is held while downloading or processing images.
+type BlobImageCache struct {
+	blobs          BlobStore
+	aspectRatioMap map[string]float64
+	fetcher        Fetcher
+	// Optional cache of aspect ratios shared with other replicas
+	shared SharedCache
+
+	downloads     *flightGroup[[]byte]
+	tileDownloads *flightGroup[[][]byte]
+	ratioLoads    *flightGroup[float64]
+
+	// Guards aspectRatioMap
+	mu sync.Mutex
+}
+
+var _ ImageCache = &BlobImageCache{}
+var _ AspectRatioStore = &BlobImageCache{}
+
+func NewBlobImageCache(blobs BlobStore, fetcher Fetcher) *BlobImageCache {
+	if fetcher == nil {
+		fetcher = NewHTTPFetcher(nil, DefaultFetcherOptions())
+	}
+
+	return &BlobImageCache{
+		blobs:          blobs,
+		aspectRatioMap: make(map[string]float64),
+		fetcher:        fetcher,
+		downloads:      newFlightGroup[[]byte](),
+		tileDownloads:  newFlightGroup[[][]byte](),
+		ratioLoads:     newFlightGroup[float64](),
+	}
+}
+
+// SetSharedCache makes the cache share aspect ratios with other replicas. It
+// must be called before the cache is used.
+func (c *BlobImageCache) SetSharedCache(shared SharedCache) {
+	c.shared = shared
+}
+
+// AspectRatios returns a copy of the calculated emote aspect ratios.
+func (c *BlobImageCache) AspectRatios() map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := make(map[string]float64, len(c.aspectRatioMap))
+	for k, v := range c.aspectRatioMap {
+		res[k] = v
+	}
+	return res
+}
+
+// RestoreAspectRatios adds previously calculated aspect ratios to the cache.
+func (c *BlobImageCache) RestoreAspectRatios(ratios map[string]float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, v := range ratios {
+		if _, ok := c.aspectRatioMap[k]; !ok {
+			c.aspectRatioMap[k] = v
+		}
+	}
+}
+
+func (c *BlobImageCache) Purge() error {
+	return c.blobs.Purge()
+}
+
+func (c *BlobImageCache) GetCachedOrDownload(ctx context.Context, emote Emote, size ImageSize, animated bool) (*Image, error) {
+	key := getFileKey(emote, size, animated)
+	data, err := c.getOrCreate(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return DownloadEmote(ctx, c.fetcher, emote, size, animated)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.newImage(key, data), nil
+}
+
+func (c *BlobImageCache) DownloadToCache(ctx context.Context, emote Emote, size ImageSize, animated bool) error {
+	key := getFileKey(emote, size, animated)
+	exists, err := c.blobs.Has(key)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = c.getOrCreate(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return DownloadEmote(ctx, c.fetcher, emote, size, animated)
+	})
+	return err
+}
+
+func (c *BlobImageCache) GetCachedOrDownloadModified(ctx context.Context, emote Emote, size ImageSize, m Modifiers, animated bool) (*Image, error) {
+	key := getModifiedFileKey(emote, size, m, animated)
+	data, err := c.getOrCreate(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return DownloadModifiedEmote(ctx, c.fetcher, emote, size, m, animated)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.newImage(key, data), nil
+}
+
+func (c *BlobImageCache) DownloadModifiedToCache(ctx context.Context, emote Emote, size ImageSize, m Modifiers, animated bool) error {
+	key := getModifiedFileKey(emote, size, m, animated)
+	exists, err := c.blobs.Has(key)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = c.getOrCreate(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return DownloadModifiedEmote(ctx, c.fetcher, emote, size, m, animated)
+	})
+	return err
+}
+
+func (c *BlobImageCache) GetCachedOrDownloadOverlay(ctx context.Context, base Emote, overlays []Emote, size ImageSize, animated bool) (*Image, error) {
+	key := getOverlayFileKey(base, overlays, size, animated)
+	data, err := c.getOrCreate(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return DownloadEmoteOverlay(ctx, c.fetcher, base, overlays, size, animated)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.newImage(key, data), nil
+}
+
+func (c *BlobImageCache) DownloadOverlayToCache(ctx context.Context, base Emote, overlays []Emote, size ImageSize, animated bool) error {
+	key := getOverlayFileKey(base, overlays, size, animated)
+	exists, err := c.blobs.Has(key)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = c.getOrCreate(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return DownloadEmoteOverlay(ctx, c.fetcher, base, overlays, size, animated)
+	})
+	return err
+}
+
+func (c *BlobImageCache) GetCachedOrDownloadTile(ctx context.Context, emote Emote, size ImageSize, tile Tile, animated bool) (*Image, error) {
+	if !tile.Valid() {
+		return nil, fmt.Errorf("invalid tile %d of %d", tile.Index, tile.Count)
+	}
+
+	key := getVirtualFileKey(emote, size, tile, animated)
+	data, err := c.blobs.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		tiles, err := c.downloadTiles(ctx, emote, size, tile.Count, animated)
+		if err != nil {
+			return nil, err
+		}
+		data = tiles[tile.Index]
+	}
+	return c.newImage(key, data), nil
+}
+
+func (c *BlobImageCache) newImage(key string, data []byte) *Image {
+	var sum string
+	if cs, ok := c.blobs.(BlobChecksummer); ok {
+		sum, _ = cs.Checksum(key)
+	}
+	if sum == "" { // not stored, or the store doesn't record checksums
+		sum = checksum(data)
+	}
+
+	img := &Image{
+		Data:        data,
+		ContentType: http.DetectContentType(data),
+		ETag:        `"` + sum[:32] + `"`,
+	}
+	if m, ok := c.blobs.(BlobModTimer); ok {
+		img.ModTime, _ = m.ModTime(key)
+	}
+	return img
+}
+
+func (c *BlobImageCache) DownloadVirtualToCache(ctx context.Context, emote Emote, size ImageSize, count int, animated bool) error {
+	for i := 0; i < count; i++ {
+		exists, err := c.blobs.Has(getVirtualFileKey(emote, size, Tile{Index: i, Count: count}, animated))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			_, err := c.downloadTiles(ctx, emote, size, count, animated)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getOrCreate returns the blob stored under key. On a miss, create is called
+// once for all concurrent callers and its result is stored.
+func (c *BlobImageCache) getOrCreate(ctx context.Context, key string, create func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	data, err := c.blobs.Get(key)
+	if err != nil || data != nil {
+		return data, err
+	}
+
+	return c.downloads.Do(ctx, key, func() ([]byte, error) {
+		// A previous call may have stored the blob since we checked
+		if data, err := c.blobs.Get(key); err != nil || data != nil {
+			return data, err
+		}
+
+		// Not tied to the caller's context, other callers may be waiting for the result
+		ctx, cancel := context.WithTimeout(context.Background(), imageDownloadTimeout)
+		defer cancel()
+
+		data, err := create(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.blobs.Put(key, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	})
+}
+
+// downloadTiles downloads and stores all count tiles of a virtual emote, once
+// for all concurrent callers.
+func (c *BlobImageCache) downloadTiles(ctx context.Context, emote Emote, size ImageSize, count int, animated bool) ([][]byte, error) {
+	key := getFileKey(emote, size, animated) + "_" + strconv.Itoa(count)
+	return c.tileDownloads.Do(ctx, key, func() ([][]byte, error) {
+		// A previous call may have stored the tiles since we checked
+		if tiles, err := c.cachedTiles(emote, size, count, animated); err != nil || tiles != nil {
+			return tiles, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), imageDownloadTimeout)
+		defer cancel()
+
+		tiles, err := DownloadEmoteTiles(ctx, c.fetcher, emote, size, count, animated)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, data := range tiles {
+			if err := c.blobs.Put(getVirtualFileKey(emote, size, Tile{Index: i, Count: count}, animated), data); err != nil {
+				return nil, err
+			}
+		}
+		return tiles, nil
+	})
+}
+
+// cachedTiles returns all count stored tiles of a virtual emote, or nil if any
+// of them is missing.
+func (c *BlobImageCache) cachedTiles(emote Emote, size ImageSize, count int, animated bool) ([][]byte, error) {
+	tiles := make([][]byte, count)
+	for i := range tiles {
+		data, err := c.blobs.Get(getVirtualFileKey(emote, size, Tile{Index: i, Count: count}, animated))
+		if err != nil || data == nil {
+			return nil, err
+		}
+		tiles[i] = data
+	}
+	return tiles, nil
+}
+
+func (c *BlobImageCache) GetEmoteAspectRatio(ctx context.Context, emote Emote) (float64, error) {
+	key := getAspectRatioKey(emote)
+	c.mu.Lock()
+	val, found := c.aspectRatioMap[key]
+	c.mu.Unlock()
+	if found {
+		return val, nil
+	}
+
+	return c.ratioLoads.Do(ctx, key, func() (float64, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), imageDownloadTimeout)
+		defer cancel()
+
+		calculated, err := c.calculateAspectRatio(ctx, key, emote)
+		if err != nil {
+			return 0, err
+		}
+
+		c.mu.Lock()
+		c.aspectRatioMap[key] = calculated
+		c.mu.Unlock()
+		return calculated, nil
+	})
+}
+
+func (c *BlobImageCache) calculateAspectRatio(ctx context.Context, key string, emote Emote) (float64, error) {
+	if c.shared != nil {
+		if val, found, err := c.shared.GetAspectRatio(key); err != nil {
+			log.Printf("Get shared aspect ratio: %v\n", err)
+		} else if found {
+			return val, nil
+		}
+	}
+
+	if stv, ok := emote.(*SevenTVEmote); ok {
+		// SevenTV provides this emote data in API responses
+		if f, ok := stv.largestFile(); ok {
+			calculated := float64(f.Width) / float64(f.Height)
+			c.publishAspectRatio(key, calculated)
+			return calculated, nil
+		}
+	}
+
+	url := emote.URL(ImageSizeSmall)
+	resp, err := getImage(ctx, c.fetcher, url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, withKind(ErrUpstreamUnavailable, err)
+	}
+
+	cfg, err := decodeImageConfig(emote.Type(), data)
+	if err != nil {
+		return 0, err
+	}
+
+	calculated := float64(cfg.Width) / float64(cfg.Height)
+
+	c.publishAspectRatio(key, calculated)
+	return calculated, nil
+}
+
+func (c *BlobImageCache) publishAspectRatio(key string, ratio float64) {
+	if c.shared == nil {
+		return
+	}
+
+	if err := c.shared.SetAspectRatio(key, ratio, sharedAspectRatioTTL); err != nil {
+		log.Printf("Set shared aspect ratio: %v\n", err)
+	}
+}
@@ -0,0 +1,207 @@
+package emotes
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCDN serves PNG emote images after a delay and counts the requests for
+// each path.
+type fakeCDN struct {
+	*httptest.Server
+	images map[string][]byte
+	delay  time.Duration
+
+	hits map[string]int
+	mu   sync.Mutex
+}
+
+func newFakeCDN(t *testing.T, delay time.Duration) *fakeCDN {
+	cdn := &fakeCDN{
+		images: make(map[string][]byte),
+		delay:  delay,
+		hits:   make(map[string]int),
+	}
+	cdn.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdn.mu.Lock()
+		cdn.hits[r.URL.Path]++
+		data, ok := cdn.images[r.URL.Path]
+		cdn.mu.Unlock()
+
+		time.Sleep(cdn.delay)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(cdn.Close)
+	return cdn
+}
+
+// encodeTestPNG encodes a mostly white PNG of the given size.
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(0, 0, color.NRGBA{R: 0xff, A: 0xff})
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode test image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// addEmote serves a solid PNG of the given size for all sizes of a BTTV emote.
+func (cdn *fakeCDN) addEmote(t *testing.T, id string, width, height int) *BttvEmote {
+	data := encodeTestPNG(t, width, height)
+
+	emote := &BttvEmote{ID: id, Code: id, ImageType: "png", cdnBase: cdn.URL}
+	cdn.mu.Lock()
+	for _, size := range []ImageSize{ImageSizeSmall, ImageSizeMedium, ImageSizeLarge} {
+		cdn.images["/"+id+"/"+size.BttvString()] = data
+	}
+	cdn.mu.Unlock()
+	return emote
+}
+
+func (cdn *fakeCDN) hitCounts() map[string]int {
+	cdn.mu.Lock()
+	defer cdn.mu.Unlock()
+
+	res := make(map[string]int, len(cdn.hits))
+	for k, v := range cdn.hits {
+		res[k] = v
+	}
+	return res
+}
+
+func TestBlobImageCacheConcurrent(t *testing.T) {
+	cdn := newFakeCDN(t, time.Millisecond*50)
+	square := cdn.addEmote(t, "square", 112, 112)
+	wide := cdn.addEmote(t, "wide", 224, 112)
+	ratio := cdn.addEmote(t, "ratio", 56, 28)
+
+	files := NewImageFileCache(t.TempDir(), time.Hour, 0, false)
+	cache := NewBlobImageCache(files, nil)
+	ctx := context.Background()
+
+	const workers = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*4)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Stagger callers so that some share downloads and others hit the cache
+			time.Sleep(time.Duration(i%25) * time.Millisecond * 4)
+
+			if _, err := cache.GetCachedOrDownload(ctx, square, ImageSizeLarge, false); err != nil {
+				errs <- err
+			}
+
+			tile := LeftHalf
+			if i%2 == 1 {
+				tile = RightHalf
+			}
+			img, err := cache.GetCachedOrDownloadTile(ctx, wide, ImageSizeLarge, tile, false)
+			if err != nil {
+				errs <- err
+			} else if len(img.Data) == 0 {
+				t.Errorf("tile %+v is empty", tile)
+			}
+
+			r, err := cache.GetEmoteAspectRatio(ctx, ratio)
+			if err != nil {
+				errs <- err
+			} else if r != 2 {
+				t.Errorf("aspect ratio = %v, want 2", r)
+			}
+
+			if i%10 == 0 {
+				if _, err := files.Evict(); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	want := map[string]int{
+		"/square/3x": 1,
+		"/wide/3x":   1,
+		"/ratio/1x":  1,
+	}
+	hits := cdn.hitCounts()
+	for path, n := range want {
+		if hits[path] != n {
+			t.Errorf("%s fetched %d times, want %d", path, hits[path], n)
+		}
+	}
+	if len(hits) != len(want) {
+		t.Errorf("unexpected upstream requests: %v", hits)
+	}
+}
+
+// recordedChecksums is a BlobStore that reports a fixed checksum for every
+// blob, to tell reused checksums apart from computed ones.
+type recordedChecksums struct {
+	BlobStore
+}
+
+func (recordedChecksums) Checksum(string) (string, bool) {
+	return strings.Repeat("ab", 32), true
+}
+
+func TestBlobImageCacheETag(t *testing.T) {
+	cdn := newFakeCDN(t, 0)
+	emote := cdn.addEmote(t, "square", 112, 112)
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name     string
+		blobs    BlobStore
+		recorded bool
+	}{
+		{"File", NewImageFileCache(t.TempDir(), time.Hour, 0, false), false},
+		{"Memory", NewMemoryBlobStore(1 << 20), false},
+		{"Recorded", recordedChecksums{NewMemoryBlobStore(1 << 20)}, true},
+		{"NotRecorded", struct{ BlobStore }{NewMemoryBlobStore(1 << 20)}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewBlobImageCache(tt.blobs, nil)
+			// Downloaded, then served from the store
+			for i := 0; i < 2; i++ {
+				img, err := cache.GetCachedOrDownload(ctx, emote, ImageSizeLarge, false)
+				if err != nil {
+					t.Fatalf("GetCachedOrDownload: %v", err)
+				}
+
+				want := `"` + checksum(img.Data)[:32] + `"`
+				if tt.recorded {
+					want = `"` + strings.Repeat("ab", 16) + `"`
+				}
+				if img.ETag != want {
+					t.Errorf("ETag = %s, want %s", img.ETag, want)
+				}
+			}
+		})
+	}
+}
@@ -1,11 +1,16 @@
 package emotes
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 const (
-	bttvCdnUrlFormat    = "https://cdn.betterttv.net/emote/%s/%s"
-	ffzCdnUrlFormat     = "https://cdn.betterttv.net/frankerfacez_emote/%s/%s"
-	sevenTVCDNUrlFormat = "https://cdn.7tv.app/emote/%s/%s"
+	bttvDefaultCDNBase    = "https://cdn.betterttv.net/emote"
+	ffzDefaultCDNBase     = "https://cdn.betterttv.net/frankerfacez_emote"
+	sevenTVDefaultCDNBase = "https://cdn.7tv.app/emote"
+
+	cdnUrlFormat = "%s/%s/%s"
 )
 
 type ImageSize int
@@ -46,19 +51,31 @@ func (s ImageSize) SevenTVString() string {
 	return s.FfzString() // use same behavior
 }
 
-func FormatBTTVEmote(id string, size ImageSize) string {
-	return fmt.Sprintf(bttvCdnUrlFormat, id, size.BttvString())
+// FormatBTTVEmote builds a BTTV CDN URL. If cdnBase is empty, the default CDN is used.
+func FormatBTTVEmote(cdnBase, id string, size ImageSize) string {
+	if cdnBase == "" {
+		cdnBase = bttvDefaultCDNBase
+	}
+	return fmt.Sprintf(cdnUrlFormat, cdnBase, id, size.BttvString())
 }
 
 func (b *BttvEmote) URL(size ImageSize) string {
-	return FormatBTTVEmote(b.ID, size)
+	return FormatBTTVEmote(b.cdnBase, b.ID, size)
 }
 
-func FormatFFZEmote(id string, size ImageSize) string {
-	return fmt.Sprintf(ffzCdnUrlFormat, id, size.FfzString())
+// FormatFFZEmote builds an FFZ CDN URL. If cdnBase is empty, the default CDN is used.
+func FormatFFZEmote(cdnBase, id string, size ImageSize) string {
+	if cdnBase == "" {
+		cdnBase = ffzDefaultCDNBase
+	}
+	return fmt.Sprintf(cdnUrlFormat, cdnBase, id, size.FfzString())
 }
 
 func (f *FfzEmote) URL(size ImageSize) string {
+	if f.cdnBase != "" { // configured CDN overrides the URLs FFZ gave us
+		return FormatFFZEmote(f.cdnBase, f.EmoteID(), size)
+	}
+
 	u := ""
 	switch size {
 	case ImageSizeSmall: // one -> two -> four
@@ -89,17 +106,49 @@ func (f *FfzEmote) URL(size ImageSize) string {
 		panic("Unknown emote size")
 	}
 
-	return "https:" + u // FFZ image URLs don't have a schema attached
+	if u == "" {
+		return FormatFFZEmote("", f.EmoteID(), size)
+	} else if strings.HasPrefix(u, "//") {
+		return "https:" + u // FFZ image URLs don't have a schema attached
+	}
+	return u
+}
+
+// FormatSevenTVEmote builds a 7TV CDN URL for an image in the given format,
+// such as "webp". If cdnBase is empty, the default CDN is used.
+func FormatSevenTVEmote(cdnBase, id string, size ImageSize, format string) string {
+	if cdnBase == "" {
+		cdnBase = sevenTVDefaultCDNBase
+	}
+	return fmt.Sprintf(cdnUrlFormat, cdnBase, id, size.SevenTVString()+"x."+strings.ToLower(format))
 }
 
 func (s *SevenTVEmote) URL(size ImageSize) string {
-	expectedSizeID := size.SevenTVString()
-	for _, sizeURLPair := range s.URLs {
-		if sizeURLPair[0] == expectedSizeID {
-			return sizeURLPair[1]
+	format := s.format()
+	if s.cdnBase != "" || s.Data == nil || s.Data.Host.URL == "" { // configured CDN overrides the host 7TV gave us
+		return FormatSevenTVEmote(s.cdnBase, s.ID, size, format)
+	}
+
+	host := s.Data.Host.URL
+	if strings.HasPrefix(host, "//") {
+		host = "https:" + host // 7TV host URLs don't have a schema attached
+	}
+
+	expectedName := size.SevenTVString() + "x." + strings.ToLower(format)
+	var fallback string
+	for _, f := range s.Data.Host.Files {
+		if f.Format != format {
+			continue
 		}
+		if f.Name == expectedName {
+			return host + "/" + f.Name
+		}
+		fallback = f.Name // files are listed from smallest to largest
 	}
 
-	// We didn't find it, build url based on blind luck? Will probably work.
-	return fmt.Sprintf(sevenTVCDNUrlFormat, s.ID, expectedSizeID+"x")
+	if fallback == "" {
+		// We didn't find it, build url based on blind luck? Will probably work.
+		return host + "/" + expectedName
+	}
+	return host + "/" + fallback
 }
@@ -0,0 +1,61 @@
+package emotes
+
+// emoteIndex maps emote IDs to emotes for each provider. Entries are
+// reference counted because the same emote can belong to many channels.
+type emoteIndex map[rune]map[string]*indexEntry
+
+type indexEntry struct {
+	emote Emote
+	refs  int
+}
+
+func (idx emoteIndex) add(emotes ProviderEmotes) {
+	for code, list := range emotes {
+		byID, ok := idx[code]
+		if !ok {
+			byID = make(map[string]*indexEntry)
+			idx[code] = byID
+		}
+
+		for _, e := range list {
+			if entry, ok := byID[e.EmoteID()]; ok {
+				entry.emote = e // prefer the most recently loaded version
+				entry.refs++
+			} else {
+				byID[e.EmoteID()] = &indexEntry{
+					emote: e,
+					refs:  1,
+				}
+			}
+		}
+	}
+}
+
+func (idx emoteIndex) remove(emotes ProviderEmotes) {
+	for code, list := range emotes {
+		byID, ok := idx[code]
+		if !ok {
+			continue
+		}
+
+		for _, e := range list {
+			entry, ok := byID[e.EmoteID()]
+			if !ok {
+				continue
+			}
+
+			entry.refs--
+			if entry.refs <= 0 {
+				delete(byID, e.EmoteID())
+			}
+		}
+	}
+}
+
+func (idx emoteIndex) get(identifierCode rune, emoteID string) (Emote, bool) {
+	entry, ok := idx[identifierCode][emoteID]
+	if !ok {
+		return nil, false
+	}
+	return entry.emote, true
+}
@@ -0,0 +1,327 @@
+package emotes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	liveHandshakeTimeout = time.Second * 10
+	liveWriteTimeout     = time.Second * 10
+	liveChangeBuffer     = 64
+	liveSendBuffer       = 64
+)
+
+var errLiveMessage = errors.New("invalid live update message")
+
+type EmoteChangeKind int
+
+const (
+	EmoteAdded EmoteChangeKind = iota
+	EmoteRemoved
+	EmoteRenamed
+)
+
+// EmoteChange is a change to a channel's emote set reported by a provider.
+type EmoteChange struct {
+	ChannelID string
+	Kind      EmoteChangeKind
+	// Identifier code of the provider
+	Provider rune
+	EmoteID  string
+	// The added emote, nil for other kinds of changes
+	Emote Emote
+	// Name of the emote after the change, or before it if it was removed
+	Name string
+	// Name of a renamed emote before the change
+	OldName string
+	// Display name of the user who made the change, if known
+	Actor string
+}
+
+var providerNames = map[rune]string{
+	'b': "BTTV",
+	'f': "FFZ",
+	's': "7TV",
+}
+
+// String describes the change for people in chat.
+func (c EmoteChange) String() string {
+	var res string
+	provider := providerNames[c.Provider]
+	switch c.Kind {
+	case EmoteAdded:
+		res = fmt.Sprintf("Added %s emote %s", provider, c.Name)
+	case EmoteRemoved:
+		res = fmt.Sprintf("Removed %s emote %s", provider, c.Name)
+	case EmoteRenamed:
+		res = fmt.Sprintf("Renamed %s emote %s to %s", provider, c.OldName, c.Name)
+	}
+
+	if c.Actor != "" {
+		res += " (by " + c.Actor + ")"
+	}
+	return res
+}
+
+// renamer is implemented by emotes that can be renamed within a set.
+type renamer interface {
+	withName(name string) Emote
+}
+
+// LiveSource reports changes to channel emote sets as they happen.
+type LiveSource interface {
+	// Subscribe starts reporting changes to a channel's emotes. Neither it nor
+	// Unsubscribe may block on the provider.
+	Subscribe(ctx context.Context, channelID string)
+	Unsubscribe(channelID string)
+	// Run connects to the provider and sends changes until ctx is done,
+	// reconnecting when the connection is lost.
+	Run(ctx context.Context, changes chan<- EmoteChange)
+}
+
+// LiveUpdates applies changes reported by live sources to an EmoteStore.
+// Sources are only subscribed to channels that are being watched.
+type LiveUpdates struct {
+	ctx     context.Context
+	store   *EmoteStore
+	sources []LiveSource
+
+	// Watchers of each channel, by watch ID
+	watchers map[string]map[int]func(EmoteChange)
+	nextID   int
+	mu       sync.Mutex
+}
+
+// NewLiveUpdates creates a LiveUpdates for the given sources. Sources stop
+// once ctx is done.
+func NewLiveUpdates(store *EmoteStore, sources []LiveSource, ctx context.Context) *LiveUpdates {
+	return &LiveUpdates{
+		ctx:      ctx,
+		store:    store,
+		sources:  sources,
+		watchers: make(map[string]map[int]func(EmoteChange)),
+	}
+}
+
+// Run runs the sources and applies their changes until the context is done.
+func (l *LiveUpdates) Run() {
+	changes := make(chan EmoteChange, liveChangeBuffer)
+	for _, source := range l.sources {
+		go source.Run(l.ctx, changes)
+	}
+
+	for {
+		select {
+		case change := <-changes:
+			l.apply(change)
+		case <-l.ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *LiveUpdates) apply(change EmoteChange) {
+	if !l.store.ApplyChange(&change) {
+		return
+	}
+
+	l.mu.Lock()
+	fns := make([]func(EmoteChange), 0, len(l.watchers[change.ChannelID]))
+	for _, fn := range l.watchers[change.ChannelID] {
+		fns = append(fns, fn)
+	}
+	l.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(change)
+	}
+}
+
+// Watch subscribes to live updates of a channel until the returned function
+// is called. fn, which may be nil, is called with every change applied to the
+// channel.
+func (l *LiveUpdates) Watch(channelID string, fn func(EmoteChange)) func() {
+	if fn == nil {
+		fn = func(EmoteChange) {}
+	}
+
+	l.mu.Lock()
+	watchers, ok := l.watchers[channelID]
+	if !ok {
+		watchers = make(map[int]func(EmoteChange))
+		l.watchers[channelID] = watchers
+		for _, source := range l.sources {
+			source.Subscribe(l.ctx, channelID)
+		}
+	}
+	id := l.nextID
+	l.nextID++
+	watchers[id] = fn
+	l.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			delete(watchers, id)
+			if len(watchers) == 0 {
+				delete(l.watchers, channelID)
+				for _, source := range l.sources {
+					source.Unsubscribe(channelID)
+				}
+			}
+		})
+	}
+}
+
+// liveSocket is a websocket connection to a provider's live update API that
+// reconnects until its context is done.
+type liveSocket struct {
+	url    string
+	dialer *websocket.Dialer
+	// Connections without messages for this long are considered lost, zero
+	// meaning never
+	readTimeout time.Duration
+	// Delay before reconnecting after the given number of consecutive failures
+	retryDelay func(failures int) time.Duration
+
+	conn *websocket.Conn
+	// Messages waiting to be written to conn
+	queue chan interface{}
+	mu    sync.Mutex
+}
+
+func newLiveSocket(url string) *liveSocket {
+	return &liveSocket{
+		url:        url,
+		retryDelay: providerRetryDelay,
+		queue:      make(chan interface{}, liveSendBuffer),
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: liveHandshakeTimeout,
+		},
+	}
+}
+
+// run keeps the socket connected until ctx is done. onConnect is called after
+// every connection is established, and handle with every message received.
+func (l *liveSocket) run(ctx context.Context, onConnect func(), handle func(data []byte)) {
+	for failures := 0; ; {
+		connected, err := l.connect(ctx, onConnect, handle)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if connected { // only back off while the provider is unreachable
+			failures = 0
+		}
+		failures++
+		log.Printf("Live updates from %s: %v\n", l.url, err)
+		if err := sleepContext(ctx, l.retryDelay(failures)); err != nil {
+			return
+		}
+	}
+}
+
+// connect connects once, returning why the connection ended and whether it
+// was established at all.
+func (l *liveSocket) connect(ctx context.Context, onConnect func(), handle func(data []byte)) (bool, error) {
+	conn, _, err := l.dialer.DialContext(ctx, l.url, http.Header{})
+	if err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	l.conn = conn
+	l.mu.Unlock()
+
+	// Messages queued for a previous connection are replaced by onConnect
+	for len(l.queue) > 0 {
+		<-l.queue
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+	go l.write(conn, done)
+
+	defer func() {
+		l.mu.Lock()
+		l.conn = nil
+		l.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	onConnect()
+	for {
+		if l.readTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(l.readTimeout))
+		}
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+		handle(data)
+	}
+}
+
+// send queues a JSON message to be written if the socket is connected, without
+// waiting for the write. Messages sent while disconnected are dropped, so
+// subscriptions must be restored by onConnect.
+func (l *liveSocket) send(v interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return
+	}
+
+	select {
+	case l.queue <- v:
+	default:
+		// Reconnecting restores subscriptions that were dropped here
+		log.Printf("Live update message queue of %s is full, reconnecting\n", l.url)
+		_ = l.conn.Close()
+	}
+}
+
+// write writes queued messages to conn until done is closed. A failed write
+// closes the connection, which run then replaces.
+func (l *liveSocket) write(conn *websocket.Conn, done <-chan struct{}) {
+	for {
+		select {
+		case v := <-l.queue:
+			_ = conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := conn.WriteJSON(v); err != nil {
+				log.Printf("Write live update message to %s: %v\n", l.url, err)
+				_ = conn.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// reconnect closes the current connection, which run then replaces.
+func (l *liveSocket) reconnect() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		_ = l.conn.Close()
+	}
+}
@@ -0,0 +1,325 @@
+package emotes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const liveTestTimeout = time.Second * 5
+
+// fakeEventConn is a connection accepted by fakeEvents.
+type fakeEventConn struct {
+	*websocket.Conn
+	// Messages received from the client
+	messages chan []byte
+}
+
+// fakeEvents is a provider websocket that hands every connection to the test.
+type fakeEvents struct {
+	*httptest.Server
+	conns chan *fakeEventConn
+}
+
+func newFakeEvents(t *testing.T) *fakeEvents {
+	events := &fakeEvents{conns: make(chan *fakeEventConn, 8)}
+	upgrader := websocket.Upgrader{}
+	events.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		c := &fakeEventConn{Conn: conn, messages: make(chan []byte, 64)}
+		events.conns <- c
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				close(c.messages)
+				return
+			}
+			c.messages <- data
+		}
+	}))
+	t.Cleanup(events.Close)
+	return events
+}
+
+func (e *fakeEvents) wsURL() string {
+	return "ws" + strings.TrimPrefix(e.URL, "http")
+}
+
+// accept waits for the next connection from the client.
+func (e *fakeEvents) accept(t *testing.T) *fakeEventConn {
+	t.Helper()
+	select {
+	case c := <-e.conns:
+		return c
+	case <-time.After(liveTestTimeout):
+		t.Fatal("timed out waiting for a connection")
+		return nil
+	}
+}
+
+// expect waits for a message from the client and decodes it into v.
+func (c *fakeEventConn) expect(t *testing.T, v interface{}) {
+	t.Helper()
+	select {
+	case data, ok := <-c.messages:
+		if !ok {
+			t.Fatal("connection closed while waiting for a message")
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("decode %s: %v", data, err)
+		}
+	case <-time.After(liveTestTimeout):
+		t.Fatal("timed out waiting for a message")
+	}
+}
+
+func (c *fakeEventConn) send(t *testing.T, msg string) {
+	t.Helper()
+	if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("write %s: %v", msg, err)
+	}
+}
+
+// startLiveUpdates loads testChannelID into a store backed by the fake
+// providers and watches it with source, returning the store and the changes
+// applied to the channel.
+func startLiveUpdates(t *testing.T, providers map[rune]*fakeProvider, source LiveSource) (*EmoteStore, <-chan EmoteChange) {
+	store := newTestStore(t, providers)
+	if err := store.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if err := store.LoadIfNotLoaded(context.Background(), testChannelID); err != nil {
+		t.Fatalf("LoadIfNotLoaded: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	live := NewLiveUpdates(store, []LiveSource{source}, ctx)
+	go live.Run()
+
+	changes := make(chan EmoteChange, 16)
+	t.Cleanup(live.Watch(testChannelID, func(change EmoteChange) {
+		changes <- change
+	}))
+	return store, changes
+}
+
+func expectChange(t *testing.T, changes <-chan EmoteChange, want EmoteChange) {
+	t.Helper()
+	select {
+	case change := <-changes:
+		change.Emote = nil
+		if change != want {
+			t.Errorf("change = %+v, want %+v", change, want)
+		}
+	case <-time.After(liveTestTimeout):
+		t.Fatalf("timed out waiting for %+v", want)
+	}
+}
+
+func expectWords(t *testing.T, store *EmoteStore, words map[string]bool) {
+	t.Helper()
+	for word, want := range words {
+		if _, ok := store.GetEmoteFromWord(word, testChannelID); ok != want {
+			t.Errorf("GetEmoteFromWord(%q) found = %v, want %v", word, ok, want)
+		}
+	}
+}
+
+func fastRetries(socket *liveSocket) {
+	socket.retryDelay = func(int) time.Duration {
+		return time.Millisecond * 10
+	}
+}
+
+func TestBttvLiveSource(t *testing.T) {
+	events := newFakeEvents(t)
+	source := NewBttvLiveSource(ProviderEndpoints{Events: events.wsURL()})
+	fastRetries(source.socket)
+	store, changes := startLiveUpdates(t, newFakeProviders(t), source)
+
+	conn := events.accept(t)
+	var join bttvSocketMessage
+	conn.expect(t, &join)
+	if join.Name != "join_channel" || string(join.Data) != `{"name":"twitch:1"}` {
+		t.Fatalf("first message = %s %s, want join of twitch:1", join.Name, join.Data)
+	}
+
+	conn.send(t, `{"name":"emote_create","data":{"channel":"twitch:1","emote":{"id":"bn","code":"BttvNew","imageType":"png"}}}`)
+	expectChange(t, changes, EmoteChange{ChannelID: testChannelID, Kind: EmoteAdded, Provider: 'b', EmoteID: "bn", Name: "BttvNew"})
+	expectWords(t, store, map[string]bool{"BttvNew": true, "BttvChannel": true})
+
+	conn.send(t, `{"name":"emote_update","data":{"channel":"twitch:1","emote":{"id":"bc","code":"BttvRenamed"}}}`)
+	expectChange(t, changes, EmoteChange{ChannelID: testChannelID, Kind: EmoteRenamed, Provider: 'b', EmoteID: "bc", Name: "BttvRenamed", OldName: "BttvChannel"})
+	expectWords(t, store, map[string]bool{"BttvRenamed": true, "BttvChannel": false})
+
+	// Other channels and other messages are ignored
+	conn.send(t, `{"name":"emote_delete","data":{"channel":"twitch:2","emoteId":"bn"}}`)
+	conn.send(t, `{"name":"lookup_user","data":{}}`)
+	conn.send(t, `{"name":"emote_delete","data":{"channel":"twitch:1","emoteId":"bn"}}`)
+	expectChange(t, changes, EmoteChange{ChannelID: testChannelID, Kind: EmoteRemoved, Provider: 'b', EmoteID: "bn", Name: "BttvNew"})
+	expectWords(t, store, map[string]bool{"BttvNew": false, "BttvRenamed": true, "BttvGlobal": true})
+
+	// Channels are joined again after reconnecting
+	_ = conn.Close()
+	conn = events.accept(t)
+	conn.expect(t, &join)
+	if join.Name != "join_channel" || string(join.Data) != `{"name":"twitch:1"}` {
+		t.Fatalf("first message after reconnecting = %s %s, want join of twitch:1", join.Name, join.Data)
+	}
+	conn.send(t, `{"name":"emote_create","data":{"channel":"twitch:1","emote":{"id":"bm","code":"BttvMore","imageType":"png"}}}`)
+	expectChange(t, changes, EmoteChange{ChannelID: testChannelID, Kind: EmoteAdded, Provider: 'b', EmoteID: "bm", Name: "BttvMore"})
+}
+
+// expectSevenTVSubscription waits for a subscription message and returns its op
+// and emote set ID.
+func expectSevenTVSubscription(t *testing.T, conn *fakeEventConn) (int, string) {
+	t.Helper()
+	var msg sevenTVEventMessage
+	conn.expect(t, &msg)
+
+	var sub sevenTVSubscription
+	if err := json.Unmarshal(msg.Data, &sub); err != nil {
+		t.Fatalf("decode subscription %s: %v", msg.Data, err)
+	}
+	if sub.Type != sevenTVEmoteSetUpdate {
+		t.Errorf("subscription type = %q, want %q", sub.Type, sevenTVEmoteSetUpdate)
+	}
+	return msg.Op, sub.Condition["object_id"]
+}
+
+func newTestSevenTVLiveSource(t *testing.T, providers map[rune]*fakeProvider, events *fakeEvents) *SevenTVLiveSource {
+	opts := DefaultFetcherOptions()
+	opts.MaxRetries = 0
+	source := NewSevenTVLiveSource(ProviderEndpoints{
+		APIBase: providers['s'].URL,
+		Events:  events.wsURL(),
+	}, NewHTTPFetcher(nil, opts))
+	fastRetries(source.socket)
+	return source
+}
+
+func TestSevenTVLiveSource(t *testing.T) {
+	events := newFakeEvents(t)
+	providers := newFakeProviders(t)
+	store, changes := startLiveUpdates(t, providers, newTestSevenTVLiveSource(t, providers, events))
+
+	conn := events.accept(t)
+	if op, setID := expectSevenTVSubscription(t, conn); op != sevenTVOpSubscribe || setID != "set" {
+		t.Fatalf("subscription = op %d of %q, want op %d of \"set\"", op, setID, sevenTVOpSubscribe)
+	}
+
+	conn.send(t, `{"op":0,"d":{"type":"emote_set.update","body":{"id":"set","actor":{"display_name":"Mod"},
+		"pushed":[{"key":"emotes","value":{"id":"sn","name":"SevenNew"}}],
+		"updated":[{"key":"emotes","value":{"id":"sc","name":"SevenRenamed"},"old_value":{"id":"sc","name":"SevenChannel"}}]}}}`)
+	expectChange(t, changes, EmoteChange{ChannelID: testChannelID, Kind: EmoteAdded, Provider: 's', EmoteID: "sn", Name: "SevenNew", Actor: "Mod"})
+	expectChange(t, changes, EmoteChange{ChannelID: testChannelID, Kind: EmoteRenamed, Provider: 's', EmoteID: "sc", Name: "SevenRenamed", OldName: "SevenChannel", Actor: "Mod"})
+	expectWords(t, store, map[string]bool{"SevenNew": true, "SevenRenamed": true, "SevenChannel": false})
+
+	// Updates of other sets are ignored
+	conn.send(t, `{"op":0,"d":{"type":"emote_set.update","body":{"id":"other","pulled":[{"key":"emotes","old_value":{"id":"sg","name":"SevenGlobal"}}]}}}`)
+	conn.send(t, `{"op":0,"d":{"type":"emote_set.update","body":{"id":"set","pulled":[{"key":"emotes","old_value":{"id":"sn","name":"SevenNew"}}]}}}`)
+	expectChange(t, changes, EmoteChange{ChannelID: testChannelID, Kind: EmoteRemoved, Provider: 's', EmoteID: "sn", Name: "SevenNew"})
+	expectWords(t, store, map[string]bool{"SevenNew": false, "SevenRenamed": true, "SevenGlobal": true})
+
+	for _, op := range []int{sevenTVOpReconnect, sevenTVOpEndOfStream} {
+		conn.send(t, fmt.Sprintf(`{"op":%d,"d":{}}`, op))
+
+		// The source reconnects and subscribes to the set again
+		conn = events.accept(t)
+		if gotOp, setID := expectSevenTVSubscription(t, conn); gotOp != sevenTVOpSubscribe || setID != "set" {
+			t.Fatalf("subscription after op %d = op %d of %q, want op %d of \"set\"", op, gotOp, setID, sevenTVOpSubscribe)
+		}
+	}
+
+	conn.send(t, `{"op":0,"d":{"type":"emote_set.update","body":{"id":"set","pushed":[{"key":"emotes","value":{"id":"sm","name":"SevenMore"}}]}}}`)
+	expectChange(t, changes, EmoteChange{ChannelID: testChannelID, Kind: EmoteAdded, Provider: 's', EmoteID: "sm", Name: "SevenMore"})
+}
+
+func TestSevenTVLiveSourceRetriesLookup(t *testing.T) {
+	events := newFakeEvents(t)
+	providers := newFakeProviders(t)
+	source := newTestSevenTVLiveSource(t, providers, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go source.Run(ctx, make(chan EmoteChange))
+	conn := events.accept(t)
+
+	providers['s'].setFailing(true)
+	source.Subscribe(ctx, testChannelID)
+	time.Sleep(time.Millisecond * 50)
+	if !source.lookingUp(testChannelID) {
+		t.Fatal("failed lookup isn't retried")
+	}
+
+	providers['s'].setFailing(false)
+	if op, setID := expectSevenTVSubscription(t, conn); op != sevenTVOpSubscribe || setID != "set" {
+		t.Fatalf("subscription = op %d of %q, want op %d of \"set\"", op, setID, sevenTVOpSubscribe)
+	}
+
+	source.Unsubscribe(testChannelID)
+	if op, setID := expectSevenTVSubscription(t, conn); op != sevenTVOpUnsubscribe || setID != "set" {
+		t.Fatalf("unsubscription = op %d of %q, want op %d of \"set\"", op, setID, sevenTVOpUnsubscribe)
+	}
+
+	// A lookup that keeps failing stops once the channel is unsubscribed
+	providers['s'].setFailing(true)
+	source.Subscribe(ctx, testChannelID)
+	time.Sleep(time.Millisecond * 20)
+	source.Unsubscribe(testChannelID)
+	time.Sleep(time.Millisecond * 50)
+
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	if len(source.channels) != 0 || len(source.sets) != 0 {
+		t.Errorf("channels = %v, sets = %v after unsubscribing", source.channels, source.sets)
+	}
+}
+
+func TestBttvLiveSourceSubscriptionOrder(t *testing.T) {
+	events := newFakeEvents(t)
+	source := NewBttvLiveSource(ProviderEndpoints{Events: events.wsURL()})
+	fastRetries(source.socket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live := NewLiveUpdates(newTestStore(t, newFakeProviders(t)), []LiveSource{source}, ctx)
+	go live.Run()
+	conn := events.accept(t)
+
+	// Wait until the socket is connected, so that nothing is dropped
+	var msg bttvSocketMessage
+	stop := live.Watch("first", nil)
+	conn.expect(t, &msg)
+	stop()
+	conn.expect(t, &msg)
+
+	// Watching and unwatching doesn't wait for the socket, and messages are
+	// written in order
+	const channels = 20
+	for i := 0; i < channels; i++ {
+		stop := live.Watch(fmt.Sprint(i), nil)
+		stop()
+	}
+	for i := 0; i < channels; i++ {
+		for _, name := range []string{"join_channel", "part_channel"} {
+			conn.expect(t, &msg)
+			want := fmt.Sprintf(`{"name":"twitch:%d"}`, i)
+			if msg.Name != name || string(msg.Data) != want {
+				t.Fatalf("message = %s %s, want %s %s", msg.Name, msg.Data, name, want)
+			}
+		}
+	}
+}
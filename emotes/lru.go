@@ -0,0 +1,96 @@
+package emotes
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache is a size-bounded, least recently used cache whose entries also
+// expire after a per-entry TTL.
+type lruCache[K comparable, V any] struct {
+	capacity int
+	entries  map[K]*list.Element
+	order    *list.List // front is most recently used
+
+	mu sync.Mutex
+}
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[K comparable, V any](capacity int) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		capacity: capacity,
+		entries:  make(map[K]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	entry := el.Value.(*lruEntry[K, V])
+	if time.Now().After(entry.expires) {
+		c.removeElement(el)
+		var zero V
+		return zero, false
+	}
+
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *lruCache[K, V]) Add(key K, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(ttl)
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*lruEntry[K, V])
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{
+		key:     key,
+		value:   value,
+		expires: expires,
+	})
+
+	for c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *lruCache[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lruCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *lruCache[K, V]) removeElement(el *list.Element) {
+	entry := c.order.Remove(el).(*lruEntry[K, V])
+	delete(c.entries, entry.key)
+}
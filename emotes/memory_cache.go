@@ -0,0 +1,123 @@
+package emotes
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MemoryBlobStore is a BlobStore that keeps images in memory, evicting the
+// least recently used ones once the total size exceeds its byte budget.
+type MemoryBlobStore struct {
+	maxBytes  int64
+	usedBytes int64
+	entries   map[string]*list.Element
+	order     *list.List // front is most recently used
+
+	mu sync.Mutex
+}
+
+type memoryBlob struct {
+	key      string
+	data     []byte
+	checksum string
+	stored   time.Time
+}
+
+var _ BlobStore = &MemoryBlobStore{}
+var _ BlobModTimer = &MemoryBlobStore{}
+var _ BlobChecksummer = &MemoryBlobStore{}
+
+func NewMemoryBlobStore(maxBytes int64) *MemoryBlobStore {
+	return &MemoryBlobStore{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (m *MemoryBlobStore) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+
+	m.order.MoveToFront(el)
+	return el.Value.(*memoryBlob).data, nil
+}
+
+func (m *MemoryBlobStore) Has(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.entries[key]
+	return ok, nil
+}
+
+func (m *MemoryBlobStore) ModTime(key string) (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return el.Value.(*memoryBlob).stored, true
+}
+
+func (m *MemoryBlobStore) Checksum(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return "", false
+	}
+	return el.Value.(*memoryBlob).checksum, true
+}
+
+func (m *MemoryBlobStore) Put(key string, data []byte) error {
+	if int64(len(data)) > m.maxBytes {
+		return nil // would never fit, don't bother
+	}
+	sum := checksum(data)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.removeElement(el)
+	}
+
+	m.entries[key] = m.order.PushFront(&memoryBlob{
+		key:      key,
+		data:     data,
+		checksum: sum,
+		stored:   time.Now(),
+	})
+	m.usedBytes += int64(len(data))
+
+	for m.usedBytes > m.maxBytes {
+		m.removeElement(m.order.Back())
+	}
+	return nil
+}
+
+func (m *MemoryBlobStore) Purge() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = make(map[string]*list.Element)
+	m.order.Init()
+	m.usedBytes = 0
+	return nil
+}
+
+func (m *MemoryBlobStore) removeElement(el *list.Element) {
+	blob := m.order.Remove(el).(*memoryBlob)
+	delete(m.entries, blob.key)
+	m.usedBytes -= int64(len(blob.data))
+}
@@ -0,0 +1,100 @@
+package emotes
+
+import (
+	"bytes"
+	"testing"
+)
+
+func blob(size int, fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, size)
+}
+
+// assertBlobs checks which keys are stored, and the bytes used by them.
+func assertBlobs(t *testing.T, m *MemoryBlobStore, usedBytes int64, present []string, absent []string) {
+	t.Helper()
+	for _, key := range present {
+		if ok, _ := m.Has(key); !ok {
+			t.Errorf("%q was evicted", key)
+		}
+	}
+	for _, key := range absent {
+		if ok, _ := m.Has(key); ok {
+			t.Errorf("%q is still stored", key)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usedBytes != usedBytes {
+		t.Errorf("usedBytes = %d, want %d", m.usedBytes, usedBytes)
+	}
+	if len(m.entries) != m.order.Len() {
+		t.Errorf("%d entries but %d in LRU order", len(m.entries), m.order.Len())
+	}
+}
+
+func TestMemoryBlobStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	m := NewMemoryBlobStore(30)
+	_ = m.Put("a", blob(10, 'a'))
+	_ = m.Put("b", blob(10, 'b'))
+	_ = m.Put("c", blob(10, 'c'))
+	assertBlobs(t, m, 30, []string{"a", "b", "c"}, nil)
+
+	// Reading a makes b the least recently used
+	if data, _ := m.Get("a"); !bytes.Equal(data, blob(10, 'a')) {
+		t.Errorf("Get(a) = %q", data)
+	}
+	_ = m.Put("d", blob(10, 'd'))
+	assertBlobs(t, m, 30, []string{"a", "c", "d"}, []string{"b"})
+
+	// Has doesn't count as a use
+	_, _ = m.Has("c")
+	_ = m.Put("e", blob(15, 'e'))
+	assertBlobs(t, m, 25, []string{"d", "e"}, []string{"a", "c"})
+
+	if data, err := m.Get("a"); data != nil || err != nil {
+		t.Errorf("Get of evicted blob = %q, %v, want nil, nil", data, err)
+	}
+}
+
+func TestMemoryBlobStorePutExistingKey(t *testing.T) {
+	m := NewMemoryBlobStore(30)
+	_ = m.Put("a", blob(10, 'a'))
+	_ = m.Put("b", blob(10, 'b'))
+
+	// Replacing a counts its new size only, and makes it the most recently
+	// used
+	_ = m.Put("a", blob(15, 'A'))
+	assertBlobs(t, m, 25, []string{"a", "b"}, nil)
+	if data, _ := m.Get("a"); !bytes.Equal(data, blob(15, 'A')) {
+		t.Errorf("Get(a) = %q, want the replacement", data)
+	}
+
+	_ = m.Put("b", blob(10, 'B'))
+	_ = m.Put("c", blob(10, 'c'))
+	assertBlobs(t, m, 20, []string{"b", "c"}, []string{"a"})
+}
+
+func TestMemoryBlobStoreOversizedBlob(t *testing.T) {
+	m := NewMemoryBlobStore(30)
+	_ = m.Put("a", blob(10, 'a'))
+
+	// A blob larger than the whole budget isn't stored and evicts nothing
+	if err := m.Put("big", blob(31, 'x')); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	assertBlobs(t, m, 10, []string{"a"}, []string{"big"})
+
+	// A blob of exactly the budget evicts everything else
+	_ = m.Put("full", blob(30, 'f'))
+	assertBlobs(t, m, 30, []string{"full"}, []string{"a"})
+}
+
+func TestMemoryBlobStorePurge(t *testing.T) {
+	m := NewMemoryBlobStore(30)
+	_ = m.Put("a", blob(10, 'a'))
+	_ = m.Purge()
+	assertBlobs(t, m, 0, nil, []string{"a"})
+
+	_ = m.Put("b", blob(30, 'b'))
+	assertBlobs(t, m, 30, []string{"b"}, nil)
+}
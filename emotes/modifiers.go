@@ -0,0 +1,114 @@
+package emotes
+
+import (
+	"strings"
+)
+
+// ModifierSeparator separates the modifier flags from the emote in a modified
+// virtual emote ID.
+const ModifierSeparator = "."
+
+// Modifiers are transformations applied to an emote image.
+type Modifiers uint8
+
+const (
+	FlipHorizontal Modifiers = 1 << iota
+	FlipVertical
+	Wide
+	RotateLeft
+	RotateRight
+)
+
+// modifierCodes are the letters of each modifier in virtual emote IDs, in
+// the order they are applied.
+var modifierCodes = []struct {
+	modifier Modifiers
+	code     byte
+}{
+	{FlipHorizontal, 'h'},
+	{FlipVertical, 'v'},
+	{RotateLeft, 'l'},
+	{RotateRight, 'r'},
+	{Wide, 'w'},
+}
+
+// bttvModifiers are the words BTTV users type before an emote to modify it.
+// z! removes the spacing around an emote, which has no meaning on mobile, so
+// it is only hidden.
+var bttvModifiers = map[string]Modifiers{
+	"h!": FlipHorizontal,
+	"v!": FlipVertical,
+	"w!": Wide,
+	"l!": RotateLeft,
+	"r!": RotateRight,
+	"z!": 0,
+}
+
+// Combine returns the modifiers of both m and o. Opposite rotations cancel
+// out.
+func (m Modifiers) Combine(o Modifiers) Modifiers {
+	m |= o
+	if m&RotateLeft != 0 && m&RotateRight != 0 {
+		m &^= RotateLeft | RotateRight
+	}
+	return m
+}
+
+// String returns the letter codes of the modifiers, e.g. "hw".
+func (m Modifiers) String() string {
+	var sb strings.Builder
+	for _, c := range modifierCodes {
+		if m&c.modifier != 0 {
+			sb.WriteByte(c.code)
+		}
+	}
+	return sb.String()
+}
+
+// ParseModifiers parses the letter codes returned by Modifiers.String.
+func ParseModifiers(s string) (Modifiers, bool) {
+	var m Modifiers
+	for i := 0; i < len(s); i++ {
+		found := false
+		for _, c := range modifierCodes {
+			if s[i] == c.code {
+				m = m.Combine(c.modifier)
+				found = true
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return m, m != 0
+}
+
+// ParseModifierWord returns the modifiers of a modifier word typed before an
+// emote, such as "h!".
+func ParseModifierWord(word string) (Modifiers, bool) {
+	m, ok := bttvModifiers[word]
+	return m, ok
+}
+
+// ModifierEmote is implemented by emotes that can modify the emote before
+// them instead of being shown.
+type ModifierEmote interface {
+	// Modifiers returns the modifiers applied to the previous emote, and
+	// whether the emote is a modifier at all.
+	Modifiers() (Modifiers, bool)
+}
+
+// EmoteModifiers returns the modifiers an emote applies to the emote before
+// it, if it is a modifier emote.
+func EmoteModifiers(emote Emote) (Modifiers, bool) {
+	if m, ok := emote.(ModifierEmote); ok {
+		return m.Modifiers()
+	}
+	return 0, false
+}
+
+// ModifiedID returns the ID that identifies an emote with modifiers applied,
+// in the form of <modifiers>.<code><id>.
+func ModifiedID(emote Emote, m Modifiers) string {
+	return m.String() + ModifierSeparator + emote.LetterCode() + emote.EmoteID()
+}
@@ -0,0 +1,147 @@
+package emotes
+
+import (
+	"image"
+	"image/draw"
+	"sort"
+	"strings"
+)
+
+const (
+	// MaxOverlayCount is the largest number of zero-width emotes drawn over a
+	// single base emote.
+	MaxOverlayCount = 4
+
+	// OverlaySeparator separates the emotes of a composite virtual emote ID.
+	OverlaySeparator = "."
+
+	// Maximum number of frames in a composited animation
+	maxCompositeFrames = 500
+	// Delay used for animation frames without one, like browsers do
+	defaultFrameDelay = 10
+)
+
+// ZeroWidthEmote is implemented by emotes that can be zero-width, meaning they
+// are drawn over the preceding emote instead of next to it.
+type ZeroWidthEmote interface {
+	ZeroWidth() bool
+}
+
+// globalEmote is implemented by emotes whose properties depend on being one of
+// their provider's global emotes. markGlobal is called on global emotes
+// restored from a snapshot, since those properties aren't serialized.
+type globalEmote interface {
+	markGlobal()
+}
+
+// IsZeroWidth reports whether an emote is a zero-width emote.
+func IsZeroWidth(emote Emote) bool {
+	z, ok := emote.(ZeroWidthEmote)
+	return ok && z.ZeroWidth()
+}
+
+// OverlayID returns the ID that identifies a base emote with overlays drawn
+// over it, in the form of <code><id>.<code><id>...
+func OverlayID(base Emote, overlays []Emote) string {
+	parts := make([]string, 0, len(overlays)+1)
+	parts = append(parts, base.LetterCode()+base.EmoteID())
+	for _, o := range overlays {
+		parts = append(parts, o.LetterCode()+o.EmoteID())
+	}
+	return strings.Join(parts, OverlaySeparator)
+}
+
+// compositeAnimations draws each layer over the previous ones. All layers
+// must have the same size. Animated layers loop independently over the
+// duration of the longest one.
+func compositeAnimations(layers []*animation) *animation {
+	var total int
+	var times []int
+	for _, layer := range layers {
+		if !layer.animated() {
+			continue
+		}
+		d := animationDuration(layer)
+		if d > total {
+			total = d
+		}
+	}
+
+	if total == 0 {
+		times = []int{0}
+	} else {
+		seen := make(map[int]bool)
+		for _, layer := range layers {
+			if !layer.animated() {
+				continue
+			}
+			for t, i := 0, 0; t < total; i = (i + 1) % len(layer.delays) {
+				if !seen[t] {
+					seen[t] = true
+					times = append(times, t)
+				}
+				t += frameDelay(layer.delays[i])
+			}
+		}
+		sort.Ints(times)
+		if len(times) > maxCompositeFrames {
+			times = times[:maxCompositeFrames]
+		}
+	}
+
+	res := &animation{}
+	bounds := layers[0].frames[0].Bounds()
+	for n, t := range times {
+		canvas := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		for _, layer := range layers {
+			frame := frameAt(layer, t)
+			draw.Draw(canvas, canvas.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		}
+
+		delay := 0
+		if total > 0 {
+			next := total
+			if n+1 < len(times) {
+				next = times[n+1]
+			}
+			delay = next - t
+		}
+
+		res.frames = append(res.frames, canvas)
+		res.delays = append(res.delays, delay)
+	}
+	return res
+}
+
+// animationDuration returns the length of one loop of an animation in 100ths
+// of a second.
+func animationDuration(a *animation) int {
+	total := 0
+	for _, d := range a.delays {
+		total += frameDelay(d)
+	}
+	return total
+}
+
+// frameAt returns the frame of a looping animation shown at time t.
+func frameAt(a *animation, t int) image.Image {
+	if !a.animated() {
+		return a.frames[0]
+	}
+
+	t %= animationDuration(a)
+	for i, d := range a.delays {
+		t -= frameDelay(d)
+		if t < 0 {
+			return a.frames[i]
+		}
+	}
+	return a.frames[len(a.frames)-1]
+}
+
+func frameDelay(d int) int {
+	if d <= 1 {
+		return defaultFrameDelay
+	}
+	return d
+}
@@ -1,13 +1,10 @@
 package emotes
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/disintegration/imaging"
 	"image"
-	"image/draw"
 	"image/gif"
-	"image/png"
 	"io/ioutil"
 	"log"
 	"os"
@@ -68,36 +65,94 @@ func InitIdealGifFrames(path string) {
 	}
 }
 
-func processImage(img image.Image, size ImageSize) ([]byte, error) {
+// processImage resizes an emote image, encoding it as a GIF if it is animated
+// and as a PNG otherwise.
+func processImage(anim *animation, size ImageSize) ([]byte, error) {
 	requiredSize := emoteSizeMap[size]
-	newImg := resizeImageWithAspectRatio(img, requiredSize, requiredSize)
+	resized := anim.mapFrames(func(frame image.Image) image.Image {
+		return resizeImageWithAspectRatio(frame, requiredSize, requiredSize)
+	})
 
-	buf := new(bytes.Buffer)
-	if err := png.Encode(buf, newImg); err != nil {
-		return nil, err
+	return encodeAnimation(resized)
+}
+
+// processModifiedImage resizes an emote image with modifiers applied. Wide
+// emotes keep their doubled width, so they are twice as wide as the usual
+// size instead of being letterboxed back into a square.
+func processModifiedImage(anim *animation, size ImageSize, m Modifiers) ([]byte, error) {
+	requiredSize := emoteSizeMap[size]
+	width := requiredSize
+	if m&Wide != 0 {
+		width *= 2
+	}
+
+	resized := anim.mapFrames(func(frame image.Image) image.Image {
+		return resizeImageWithAspectRatio(frame, width, requiredSize)
+	})
+	return encodeAnimation(resized)
+}
+
+// applyModifiers transforms every frame of an emote image.
+func applyModifiers(anim *animation, m Modifiers) *animation {
+	return anim.mapFrames(func(frame image.Image) image.Image {
+		if m&FlipHorizontal != 0 {
+			frame = imaging.FlipH(frame)
+		}
+		if m&FlipVertical != 0 {
+			frame = imaging.FlipV(frame)
+		}
+		if m&RotateLeft != 0 {
+			frame = imaging.Rotate90(frame)
+		}
+		if m&RotateRight != 0 {
+			frame = imaging.Rotate270(frame)
+		}
+		if m&Wide != 0 {
+			bounds := frame.Bounds()
+			frame = imaging.Resize(frame, bounds.Dx()*2, bounds.Dy(), imaging.Lanczos)
+		}
+		return frame
+	})
+}
+
+// processImageOverlay resizes a base emote image and the images of the emotes
+// drawn over it, and composites them into a single image.
+func processImageOverlay(layers []*animation, size ImageSize) ([]byte, error) {
+	requiredSize := emoteSizeMap[size]
+	resized := make([]*animation, len(layers))
+	for i, layer := range layers {
+		resized[i] = layer.mapFrames(func(frame image.Image) image.Image {
+			return resizeImageWithAspectRatio(frame, requiredSize, requiredSize)
+		})
 	}
 
-	return buf.Bytes(), nil
+	return encodeAnimation(compositeAnimations(resized))
 }
 
-func processImageHalves(img image.Image, size ImageSize) ([]byte, []byte, error) {
+// processImageTiles resizes an emote image to count times the usual width and
+// splits it into count square tiles.
+func processImageTiles(anim *animation, size ImageSize, count int) ([][]byte, error) {
 	requiredSize := emoteSizeMap[size]
 
-	newImg := resizeImageWithAspectRatio(img, requiredSize*2, requiredSize) // double width for wide emotes
-	leftImg := imaging.Crop(newImg, image.Rect(0, 0, requiredSize, requiredSize))
-	rightImg := imaging.Crop(newImg, image.Rect(requiredSize, 0, requiredSize*2, requiredSize))
+	resized := anim.mapFrames(func(frame image.Image) image.Image {
+		return resizeImageWithAspectRatio(frame, requiredSize*count, requiredSize)
+	})
 
-	left := new(bytes.Buffer)
-	right := new(bytes.Buffer)
+	tiles := make([][]byte, count)
+	for i := range tiles {
+		rect := image.Rect(requiredSize*i, 0, requiredSize*(i+1), requiredSize)
+		tile := resized.mapFrames(func(frame image.Image) image.Image {
+			return imaging.Crop(frame, rect)
+		})
 
-	if err := png.Encode(left, leftImg); err != nil {
-		return nil, nil, fmt.Errorf("encode left half: %w", err)
-	}
-	if err := png.Encode(right, rightImg); err != nil {
-		return nil, nil, fmt.Errorf("encode right half: %w", err)
+		data, err := encodeAnimation(tile)
+		if err != nil {
+			return nil, fmt.Errorf("encode tile %d: %w", i, err)
+		}
+		tiles[i] = data
 	}
 
-	return left.Bytes(), right.Bytes(), nil
+	return tiles, nil
 }
 
 func resizeImageWithAspectRatio(img image.Image, targetWidth, targetHeight int) image.Image {
@@ -118,7 +173,7 @@ func resizeImageWithAspectRatio(img image.Image, targetWidth, targetHeight int)
 	return newImg
 }
 
-func selectGifFrame(emote Emote, g *gif.GIF) image.Image {
+func selectGifFrame(emote Emote, g *gif.GIF) (image.Image, error) {
 	key := emote.LetterCode() + ":" + emote.EmoteID()
 	if idealGifFrames == nil {
 		return getGifFrame(g, 0)
@@ -128,35 +183,20 @@ func selectGifFrame(emote Emote, g *gif.GIF) image.Image {
 	}
 }
 
-func getGifFrame(g *gif.GIF, stopFrame int) image.Image {
+func getGifFrame(g *gif.GIF, stopFrame int) (image.Image, error) {
 	if stopFrame > len(g.Image)-1 || stopFrame < 0 { // safety checks
 		stopFrame = 0
 	}
 
 	if len(g.Image) == 1 || stopFrame == 0 {
-		return g.Image[0]
+		return g.Image[0], nil
 	}
 
-	// Create canvas
-	width, height := getGifDimensions(g)
-	result := image.NewRGBA(image.Rect(0, 0, width, height))
-
-	// Draw first frame
-	draw.Draw(result, result.Bounds(), g.Image[0], image.Point{}, draw.Src)
-	for i := 1; i <= stopFrame; i++ {
-		// Yes, not a correct implementation of disposal methods but it works
-		var op draw.Op
-		switch g.Disposal[i-1] {
-		case gif.DisposalBackground: // clear and replace existing with current frame
-			op = draw.Src
-		case gif.DisposalNone, gif.DisposalPrevious: // impose current frame over existing
-			op = draw.Over
-		}
-
-		draw.Draw(result, result.Bounds(), g.Image[i], image.Point{}, op)
+	anim, err := coalesceGif(g, stopFrame)
+	if err != nil {
+		return nil, err
 	}
-
-	return result
+	return anim.frames[stopFrame], nil
 }
 
 func getGifDimensions(g *gif.GIF) (int, int) {
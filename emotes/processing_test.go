@@ -0,0 +1,69 @@
+package emotes
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"testing"
+	"time"
+)
+
+func TestModifiedEmoteDimensions(t *testing.T) {
+	cdn := newFakeCDN(t, 0)
+	square := cdn.addEmote(t, "square", 112, 112)
+	cache := NewBlobImageCache(NewImageFileCache(t.TempDir(), time.Hour, 0, false), nil)
+
+	tests := []struct {
+		name          string
+		m             Modifiers
+		size          ImageSize
+		width, height int
+	}{
+		{"Flip", FlipHorizontal, ImageSizeLarge, 112, 112},
+		{"Rotate", RotateLeft, ImageSizeLarge, 112, 112},
+		{"Wide", Wide, ImageSizeLarge, 224, 112},
+		{"WideSmall", Wide, ImageSizeSmall, 56, 28},
+		{"WideFlipped", Wide | FlipVertical, ImageSizeMedium, 112, 56},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := cache.GetCachedOrDownloadModified(context.Background(), square, tt.size, tt.m, false)
+			if err != nil {
+				t.Fatalf("GetCachedOrDownloadModified: %v", err)
+			}
+
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+			if err != nil {
+				t.Fatalf("decode modified image: %v", err)
+			}
+			if cfg.Width != tt.width || cfg.Height != tt.height {
+				t.Errorf("size = %dx%d, want %dx%d", cfg.Width, cfg.Height, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestWideEmoteIsNotLetterboxed(t *testing.T) {
+	frame := image.NewNRGBA(image.Rect(0, 0, 112, 112))
+	for i := range frame.Pix {
+		frame.Pix[i] = 0xff
+	}
+
+	data, err := processModifiedImage(applyModifiers(staticAnimation(frame), Wide), ImageSizeLarge, Wide)
+	if err != nil {
+		t.Fatalf("processModifiedImage: %v", err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	// The stretched emote fills the whole image, with no transparent bars
+	bounds := img.Bounds()
+	for _, p := range []image.Point{{0, 0}, {bounds.Dx() / 2, 0}, {bounds.Dx() - 1, bounds.Dy() - 1}} {
+		if _, _, _, a := img.At(p.X, p.Y).RGBA(); a != 0xffff {
+			t.Errorf("pixel %v alpha = %#x, want opaque", p, a)
+		}
+	}
+}
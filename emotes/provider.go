@@ -1,5 +1,10 @@
 package emotes
 
+import (
+	"context"
+	"encoding/json"
+)
+
 func convertToEmoteSlice[EmoteType Emote](s []EmoteType) []Emote {
 	asEmote := make([]Emote, len(s), len(s))
 	for i := range s {
@@ -10,9 +15,9 @@ func convertToEmoteSlice[EmoteType Emote](s []EmoteType) []Emote {
 
 type Provider interface {
 	IdentifierCode() rune
-	LoadGlobalEmotes() ([]Emote, error)
-	LoadChannelEmotes(channelID string) ([]Emote, error)
-	LoadSpecificEmote(emoteID string) (Emote, error)
+	LoadGlobalEmotes(ctx context.Context) ([]Emote, error)
+	LoadChannelEmotes(ctx context.Context, channelID string) ([]Emote, error)
+	LoadSpecificEmote(ctx context.Context, emoteID string) (Emote, error)
 }
 
 // Interface type constraints
@@ -20,14 +25,29 @@ var _ Provider = &BttvProvider{}
 var _ Provider = &FfzProvider{}
 var _ Provider = &SevenTVProvider{}
 
-type BttvProvider struct{}
+var _ emoteDecoder = &BttvProvider{}
+var _ emoteDecoder = &FfzProvider{}
+var _ emoteDecoder = &SevenTVProvider{}
+
+// NewBttvProvider creates a BTTV provider that talks to the given endpoints using fetcher.
+func NewBttvProvider(endpoints ProviderEndpoints, fetcher Fetcher) *BttvProvider {
+	return &BttvProvider{
+		endpoints: endpoints,
+		fetcher:   fetcher,
+	}
+}
+
+type BttvProvider struct {
+	endpoints ProviderEndpoints
+	fetcher   Fetcher
+}
 
 func (b BttvProvider) IdentifierCode() rune {
 	return 'b'
 }
 
-func (b BttvProvider) LoadGlobalEmotes() ([]Emote, error) {
-	res, err := GetGlobalBTTVEmotes()
+func (b BttvProvider) LoadGlobalEmotes(ctx context.Context) ([]Emote, error) {
+	res, err := GetGlobalBTTVEmotes(ctx, b.fetcher, b.endpoints)
 	if err != nil {
 		return nil, err
 	}
@@ -35,8 +55,8 @@ func (b BttvProvider) LoadGlobalEmotes() ([]Emote, error) {
 	return convertToEmoteSlice(res), nil
 }
 
-func (b BttvProvider) LoadChannelEmotes(channelID string) ([]Emote, error) {
-	res, err := GetChannelBTTVEmotes(channelID)
+func (b BttvProvider) LoadChannelEmotes(ctx context.Context, channelID string) ([]Emote, error) {
+	res, err := GetChannelBTTVEmotes(ctx, b.fetcher, b.endpoints, channelID)
 	if err != nil {
 		return nil, err
 	}
@@ -44,18 +64,29 @@ func (b BttvProvider) LoadChannelEmotes(channelID string) ([]Emote, error) {
 	return convertToEmoteSlice(res), nil
 }
 
-func (b BttvProvider) LoadSpecificEmote(emoteID string) (Emote, error) {
-	return GetSpecificBTTVEmote(emoteID)
+func (b BttvProvider) LoadSpecificEmote(ctx context.Context, emoteID string) (Emote, error) {
+	return GetSpecificBTTVEmote(ctx, b.fetcher, b.endpoints, emoteID)
 }
 
-type FfzProvider struct{}
+// NewFfzProvider creates an FFZ provider that talks to the given endpoints using fetcher.
+func NewFfzProvider(endpoints ProviderEndpoints, fetcher Fetcher) *FfzProvider {
+	return &FfzProvider{
+		endpoints: endpoints,
+		fetcher:   fetcher,
+	}
+}
+
+type FfzProvider struct {
+	endpoints ProviderEndpoints
+	fetcher   Fetcher
+}
 
 func (f FfzProvider) IdentifierCode() rune {
 	return 'f'
 }
 
-func (f FfzProvider) LoadGlobalEmotes() ([]Emote, error) {
-	res, err := GetGlobalFFZEmotes()
+func (f FfzProvider) LoadGlobalEmotes(ctx context.Context) ([]Emote, error) {
+	res, err := GetGlobalFFZEmotes(ctx, f.fetcher, f.endpoints)
 	if err != nil {
 		return nil, err
 	}
@@ -63,8 +94,8 @@ func (f FfzProvider) LoadGlobalEmotes() ([]Emote, error) {
 	return convertToEmoteSlice(res), nil
 }
 
-func (f FfzProvider) LoadChannelEmotes(channelID string) ([]Emote, error) {
-	res, err := GetChannelFFZEmotes(channelID)
+func (f FfzProvider) LoadChannelEmotes(ctx context.Context, channelID string) ([]Emote, error) {
+	res, err := GetChannelFFZEmotes(ctx, f.fetcher, f.endpoints, channelID)
 	if err != nil {
 		return nil, err
 	}
@@ -72,18 +103,29 @@ func (f FfzProvider) LoadChannelEmotes(channelID string) ([]Emote, error) {
 	return convertToEmoteSlice(res), nil
 }
 
-func (f FfzProvider) LoadSpecificEmote(emoteID string) (Emote, error) {
-	return GetSpecificFFZEmote(emoteID)
+func (f FfzProvider) LoadSpecificEmote(ctx context.Context, emoteID string) (Emote, error) {
+	return GetSpecificFFZEmote(ctx, f.fetcher, f.endpoints, emoteID)
+}
+
+// NewSevenTVProvider creates a 7TV provider that talks to the given endpoints using fetcher.
+func NewSevenTVProvider(endpoints ProviderEndpoints, fetcher Fetcher) *SevenTVProvider {
+	return &SevenTVProvider{
+		endpoints: endpoints,
+		fetcher:   fetcher,
+	}
 }
 
-type SevenTVProvider struct{}
+type SevenTVProvider struct {
+	endpoints ProviderEndpoints
+	fetcher   Fetcher
+}
 
 func (s SevenTVProvider) IdentifierCode() rune {
 	return 's'
 }
 
-func (s SevenTVProvider) LoadGlobalEmotes() ([]Emote, error) {
-	res, err := GetGlobalSevenTVEmotes()
+func (s SevenTVProvider) LoadGlobalEmotes(ctx context.Context) ([]Emote, error) {
+	res, err := GetGlobalSevenTVEmotes(ctx, s.fetcher, s.endpoints)
 	if err != nil {
 		return nil, err
 	}
@@ -92,8 +134,8 @@ func (s SevenTVProvider) LoadGlobalEmotes() ([]Emote, error) {
 
 }
 
-func (s SevenTVProvider) LoadChannelEmotes(channelID string) ([]Emote, error) {
-	res, err := GetChannelSevenTVEmotes(channelID)
+func (s SevenTVProvider) LoadChannelEmotes(ctx context.Context, channelID string) ([]Emote, error) {
+	res, err := GetChannelSevenTVEmotes(ctx, s.fetcher, s.endpoints, channelID)
 	if err != nil {
 		return nil, err
 	}
@@ -101,6 +143,35 @@ func (s SevenTVProvider) LoadChannelEmotes(channelID string) ([]Emote, error) {
 	return convertToEmoteSlice(res), nil
 }
 
-func (s SevenTVProvider) LoadSpecificEmote(emoteID string) (Emote, error) {
-	return GetSpecificSevenTVEmote(emoteID)
+func (s SevenTVProvider) LoadSpecificEmote(ctx context.Context, emoteID string) (Emote, error) {
+	return GetSpecificSevenTVEmote(ctx, s.fetcher, s.endpoints, emoteID)
+}
+
+func decodeEmoteSlice[EmoteType Emote](data []byte, stamp func(EmoteType)) ([]Emote, error) {
+	var res []EmoteType
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	for _, e := range res {
+		stamp(e)
+	}
+	return convertToEmoteSlice(res), nil
+}
+
+func (b BttvProvider) decodeEmotes(data []byte) ([]Emote, error) {
+	return decodeEmoteSlice(data, func(e *BttvEmote) {
+		e.cdnBase = b.endpoints.CDNBase
+	})
+}
+
+func (f FfzProvider) decodeEmotes(data []byte) ([]Emote, error) {
+	return decodeEmoteSlice(data, func(e *FfzEmote) {
+		e.cdnBase = f.endpoints.CDNBase
+	})
+}
+
+func (s SevenTVProvider) decodeEmotes(data []byte) ([]Emote, error) {
+	return decodeEmoteSlice(data, func(e *SevenTVEmote) {
+		e.cdnBase = s.endpoints.CDNBase
+	})
 }
@@ -0,0 +1,67 @@
+package emotes
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that refills at rate tokens per second up to burst.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// Rejected events not yet reported
+	rejected   int
+	lastReport time.Time
+
+	mu sync.Mutex
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow reports whether an event may happen now, consuming a token if so.
+func (l *rateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Reject records a rejected event. Once every interval it returns the number
+// of events rejected since the last report, so rejections can be logged
+// without logging each one.
+func (l *rateLimiter) Reject(interval time.Duration) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rejected++
+	now := time.Now()
+	if now.Sub(l.lastReport) < interval {
+		return 0, false
+	}
+
+	n := l.rejected
+	l.rejected = 0
+	l.lastReport = now
+	return n, true
+}
@@ -0,0 +1,34 @@
+package emotes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReject(t *testing.T) {
+	l := newRateLimiter(0, 1)
+	if !l.Allow() {
+		t.Fatal("first event was not allowed")
+	}
+
+	reported := 0
+	for i := 0; i < 100; i++ {
+		if l.Allow() {
+			t.Fatal("event allowed beyond burst")
+		}
+		if n, ok := l.Reject(time.Hour); ok {
+			reported++
+			if n != 1 {
+				t.Errorf("first report counted %d rejections, want 1", n)
+			}
+		}
+	}
+	if reported != 1 {
+		t.Errorf("reported %d times within one interval, want 1", reported)
+	}
+
+	n, ok := l.Reject(0)
+	if !ok || n != 100 {
+		t.Errorf("Reject after interval = %d, %v, want 100, true", n, ok)
+	}
+}
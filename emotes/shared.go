@@ -0,0 +1,137 @@
+package emotes
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	sharedChannelTTL     = time.Hour * 24
+	sharedAspectRatioTTL = sharedChannelTTL
+	sharedWaitTimeout    = time.Second * 10
+	sharedPollInterval   = time.Millisecond * 500
+	sharedChannelLockTTL = channelLoadTimeout
+)
+
+// SharedCache stores emote metadata shared between several server replicas.
+type SharedCache interface {
+	// GetChannel returns the serialized emote set of a channel, or nil if there is none.
+	GetChannel(channelID string) ([]byte, error)
+	SetChannel(channelID string, data []byte, ttl time.Duration) error
+
+	// GetAspectRatio returns the aspect ratio stored for key, if any.
+	GetAspectRatio(key string) (float64, bool, error)
+	SetAspectRatio(key string, ratio float64, ttl time.Duration) error
+
+	// Lock tries to acquire the named lock for at most ttl. It returns a
+	// function releasing the lock, or nil if the lock is held elsewhere.
+	Lock(name string, ttl time.Duration) (func(), error)
+}
+
+// SetSharedCache makes the store share channel emote sets with other
+// replicas. It must be called before the store is used.
+func (s *EmoteStore) SetSharedCache(shared SharedCache) {
+	s.shared = shared
+}
+
+// loadShared loads a channel's emotes, preferring a fresh set published by
+// another replica. Only the replica holding the channel's lock requests the
+// providers; the others wait for its result.
+func (s *EmoteStore) loadShared(channelID string, providers []Provider, force bool) (*channelSet, error) {
+	s.mu.RLock()
+	previous := s.channels[channelID]
+	s.mu.RUnlock()
+
+	if !force {
+		if set := s.freshSharedChannel(channelID, previous); set != nil {
+			s.putChannel(channelID, set)
+			return set, nil
+		}
+	}
+
+	unlock, err := s.shared.Lock("channel:"+channelID, sharedChannelLockTTL)
+	if err != nil {
+		log.Printf("Lock shared channel %q: %v\n", channelID, err)
+		return s.load(channelID, providers)
+	}
+
+	if unlock == nil { // another replica is loading the channel
+		if set := s.waitForSharedChannel(channelID, previous); set != nil {
+			s.putChannel(channelID, set)
+			return set, nil
+		}
+		return s.load(channelID, providers)
+	}
+	defer unlock()
+
+	set, err := s.load(channelID, providers)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(set.failures) == 0 { // only publish complete sets
+		if err := s.publishChannel(channelID, set); err != nil {
+			log.Printf("Publish shared channel %q: %v\n", channelID, err)
+		}
+	}
+	return set, nil
+}
+
+// freshSharedChannel returns the shared set of a channel if it is fresh and
+// newer than previous.
+func (s *EmoteStore) freshSharedChannel(channelID string, previous *channelSet) *channelSet {
+	data, err := s.shared.GetChannel(channelID)
+	if err != nil {
+		log.Printf("Get shared channel %q: %v\n", channelID, err)
+		return nil
+	} else if data == nil {
+		return nil
+	}
+
+	var channel channelSnapshot
+	if err := json.Unmarshal(data, &channel); err != nil {
+		log.Printf("Decode shared channel %q: %v\n", channelID, err)
+		return nil
+	}
+
+	if time.Since(channel.Loaded) > cachedEmoteDuration {
+		return nil
+	} else if previous != nil && !channel.Loaded.After(previous.loaded) {
+		return nil
+	}
+
+	set, err := s.decodeChannelSet(&channel)
+	if err != nil {
+		log.Printf("Decode shared channel %q: %v\n", channelID, err)
+		return nil
+	}
+	return set
+}
+
+func (s *EmoteStore) waitForSharedChannel(channelID string, previous *channelSet) *channelSet {
+	deadline := time.Now().Add(sharedWaitTimeout)
+	for time.Now().Before(deadline) {
+		if err := sleepContext(s.ctx, sharedPollInterval); err != nil {
+			return nil
+		}
+		if set := s.freshSharedChannel(channelID, previous); set != nil {
+			return set
+		}
+	}
+	return nil
+}
+
+func (s *EmoteStore) publishChannel(channelID string, set *channelSet) error {
+	channel, err := encodeChannelSet(set)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(channel)
+	if err != nil {
+		return err
+	}
+
+	return s.shared.SetChannel(channelID, data, sharedChannelTTL)
+}
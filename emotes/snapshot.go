@@ -0,0 +1,316 @@
+package emotes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const snapshotVersion = 2
+
+// SnapshotBackend persists serialized snapshots of emote metadata.
+type SnapshotBackend interface {
+	// LoadSnapshot returns the last saved snapshot, or nil if there is none.
+	LoadSnapshot() ([]byte, error)
+	SaveSnapshot(data []byte) error
+}
+
+// AspectRatioStore is implemented by image caches whose calculated aspect
+// ratios can be saved and restored.
+type AspectRatioStore interface {
+	AspectRatios() map[string]float64
+	RestoreAspectRatios(ratios map[string]float64)
+}
+
+// emoteDecoder is implemented by providers that can decode emotes they
+// previously returned from their serialized JSON form.
+type emoteDecoder interface {
+	decodeEmotes(data []byte) ([]Emote, error)
+}
+
+type storeSnapshot struct {
+	Version      int                        `json:"version"`
+	Created      time.Time                  `json:"created"`
+	Globals      map[string]json.RawMessage `json:"globals"`
+	Channels     map[string]channelSnapshot `json:"channels"`
+	AspectRatios map[string]float64         `json:"aspect_ratios,omitempty"`
+}
+
+type channelSnapshot struct {
+	Loaded time.Time                  `json:"loaded"`
+	Emotes map[string]json.RawMessage `json:"emotes"`
+}
+
+func encodeProviderEmotes(emotes ProviderEmotes) (map[string]json.RawMessage, error) {
+	res := make(map[string]json.RawMessage, len(emotes))
+	for code, list := range emotes {
+		data, err := json.Marshal(list)
+		if err != nil {
+			return nil, fmt.Errorf("encode %q emotes: %w", code, err)
+		}
+		res[string(code)] = data
+	}
+	return res, nil
+}
+
+func (s *EmoteStore) decodeProviderEmotes(encoded map[string]json.RawMessage) (ProviderEmotes, error) {
+	res := make(ProviderEmotes, len(encoded))
+	for codeString, data := range encoded {
+		code := []rune(codeString)[0]
+		provider, ok := s.ProviderFromCode(code)
+		if !ok {
+			continue // provider was removed since the snapshot was taken
+		}
+
+		decoder, ok := provider.(emoteDecoder)
+		if !ok {
+			continue
+		}
+
+		emotes, err := decoder.decodeEmotes(data)
+		if err != nil {
+			return nil, fmt.Errorf("decode %q emotes: %w", code, err)
+		}
+		res[code] = emotes
+	}
+	return res, nil
+}
+
+func encodeChannelSet(set *channelSet) (*channelSnapshot, error) {
+	emotes, err := encodeProviderEmotes(set.emotes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &channelSnapshot{
+		Loaded: set.loaded,
+		Emotes: emotes,
+	}, nil
+}
+
+func (s *EmoteStore) decodeChannelSet(channel *channelSnapshot) (*channelSet, error) {
+	emotes, err := s.decodeProviderEmotes(channel.Emotes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &channelSet{
+		emotes:  emotes,
+		wordMap: s.buildWordMap(emotes),
+		loaded:  channel.Loaded,
+	}, nil
+}
+
+func (s *EmoteStore) exportSnapshot() (*storeSnapshot, error) {
+	s.mu.RLock()
+	globalEmotes := make(ProviderEmotes, len(s.globalEmotes))
+	for code, emotes := range s.globalEmotes {
+		globalEmotes[code] = emotes
+	}
+	channels := make(map[string]*channelSet, len(s.channels))
+	for id, set := range s.channels {
+		channels[id] = set
+	}
+	s.mu.RUnlock()
+
+	globals, err := encodeProviderEmotes(globalEmotes)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &storeSnapshot{
+		Version:  snapshotVersion,
+		Created:  time.Now(),
+		Globals:  globals,
+		Channels: make(map[string]channelSnapshot, len(channels)),
+	}
+
+	for id, set := range channels {
+		channel, err := encodeChannelSet(set)
+		if err != nil {
+			return nil, fmt.Errorf("channel %q: %w", id, err)
+		}
+		snap.Channels[id] = *channel
+	}
+
+	return snap, nil
+}
+
+// restoreSnapshot hydrates the store. Word maps are rebuilt from the restored
+// sets, and sets that were loaded after the snapshot was taken are kept.
+func (s *EmoteStore) restoreSnapshot(snap *storeSnapshot) error {
+	globals, err := s.decodeProviderEmotes(snap.Globals)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	for code, emotes := range globals {
+		if _, loaded := s.globalEmotes[code]; loaded {
+			continue
+		}
+		for _, e := range emotes {
+			if g, ok := e.(globalEmote); ok {
+				g.markGlobal()
+			}
+		}
+		s.index.add(ProviderEmotes{code: emotes})
+		s.globalEmotes[code] = emotes
+		s.health.setGlobalsLoaded(code)
+	}
+	s.mu.Unlock()
+
+	for id, channel := range snap.Channels {
+		set, err := s.decodeChannelSet(&channel)
+		if err != nil {
+			return fmt.Errorf("channel %q: %w", id, err)
+		}
+
+		s.mu.Lock()
+		if _, loaded := s.channels[id]; !loaded {
+			s.index.add(set.emotes)
+			s.channels[id] = set
+		}
+		s.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Snapshotter periodically saves the emote store (and optionally image
+// aspect ratios) so that a restarted server can serve emotes immediately.
+type Snapshotter struct {
+	store    *EmoteStore
+	ratios   AspectRatioStore
+	backend  SnapshotBackend
+	interval time.Duration
+}
+
+// NewSnapshotter creates a Snapshotter. ratios may be nil.
+func NewSnapshotter(store *EmoteStore, ratios AspectRatioStore, backend SnapshotBackend, interval time.Duration) *Snapshotter {
+	return &Snapshotter{
+		store:    store,
+		ratios:   ratios,
+		backend:  backend,
+		interval: interval,
+	}
+}
+
+// Restore hydrates the store from the last saved snapshot. It returns whether
+// a snapshot was found.
+func (s *Snapshotter) Restore() (bool, error) {
+	data, err := s.backend.LoadSnapshot()
+	if err != nil {
+		return false, fmt.Errorf("load snapshot: %w", err)
+	} else if data == nil {
+		return false, nil
+	}
+
+	var snap storeSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return false, fmt.Errorf("decode snapshot: %w", err)
+	}
+
+	if snap.Version != snapshotVersion {
+		log.Printf("Ignoring snapshot with version %d\n", snap.Version)
+		return false, nil
+	}
+
+	if err := s.store.restoreSnapshot(&snap); err != nil {
+		return false, fmt.Errorf("restore snapshot: %w", err)
+	}
+
+	if s.ratios != nil && snap.AspectRatios != nil {
+		s.ratios.RestoreAspectRatios(snap.AspectRatios)
+	}
+
+	log.Printf("Restored snapshot from %s with %d channels\n", snap.Created.Format(time.RFC3339), len(snap.Channels))
+	return true, nil
+}
+
+func (s *Snapshotter) Save() error {
+	snap, err := s.store.exportSnapshot()
+	if err != nil {
+		return fmt.Errorf("export snapshot: %w", err)
+	}
+
+	if s.ratios != nil {
+		snap.AspectRatios = s.ratios.AspectRatios()
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("encode snapshot: %w", err)
+	}
+
+	if err := s.backend.SaveSnapshot(data); err != nil {
+		return fmt.Errorf("save snapshot: %w", err)
+	}
+	return nil
+}
+
+// Run saves a snapshot every interval until ctx is done, then saves a final one.
+func (s *Snapshotter) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.Printf("Snapshot: %v\n", err)
+			}
+		case <-ctx.Done():
+			if err := s.Save(); err != nil {
+				log.Printf("Snapshot: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+// FileSnapshotBackend stores snapshots in a single file on disk.
+type FileSnapshotBackend struct {
+	path string
+}
+
+var _ SnapshotBackend = &FileSnapshotBackend{}
+
+func NewFileSnapshotBackend(path string) *FileSnapshotBackend {
+	return &FileSnapshotBackend{
+		path: path,
+	}
+}
+
+func (f *FileSnapshotBackend) LoadSnapshot() ([]byte, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (f *FileSnapshotBackend) SaveSnapshot(data []byte) error {
+	// Write to a temporary file first so a crash never leaves a partial snapshot
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
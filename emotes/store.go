@@ -1,113 +1,544 @@
 package emotes
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
 	cachedEmoteDuration = time.Hour
+	channelLoadTimeout  = time.Second * 30
+
+	danglingEmoteCapacity = 4096
+	danglingEmoteDuration = time.Hour
+	unknownEmoteDuration  = time.Minute * 10
+
+	// Limits on requests for emotes that aren't part of any loaded set, per provider
+	specificEmoteRate  = 5
+	specificEmoteBurst = 20
+	// Rate limited lookups are logged at most once per interval
+	rateLimitReportInterval = time.Minute
 )
 
 type ProviderEmotes map[rune][]Emote
 type WordMap map[string]Emote
 
+// channelSet is an immutable snapshot of a channel's emotes. It is replaced
+// as a whole when the channel is reloaded.
+type channelSet struct {
+	emotes  ProviderEmotes
+	wordMap WordMap
+	loaded  time.Time
+
+	// Providers that failed to load for this channel, by identifier code
+	failures map[rune]*providerFailure
+}
+
+// dueRetries returns the providers that failed to load and should be retried.
+func (c *channelSet) dueRetries(providers []Provider) []Provider {
+	var due []Provider
+	now := time.Now()
+	for _, p := range providers {
+		if f, ok := c.failures[p.IdentifierCode()]; ok && now.After(f.retryAt) {
+			due = append(due, p)
+		}
+	}
+	return due
+}
+
 type EmoteStore struct {
+	ctx       context.Context
 	providers []Provider
 
 	// Globally available emotes
 	globalEmotes ProviderEmotes
 
-	// Emotes that were requested but not found in any other channel
-	danglingEmotes ProviderEmotes
+	// Emotes that were requested but not found in any other channel. A nil
+	// value records an ID that the provider doesn't know.
+	danglingEmotes *lruCache[string, Emote]
+	specificLoads  *flightGroup[Emote]
+	specificLimits map[rune]*rateLimiter
 
 	// Emotes belonging to channels
-	channels     map[string]ProviderEmotes
-	channelTimes map[string]time.Time
-	wordMaps     map[string]WordMap
+	channels map[string]*channelSet
+	loads    *flightGroup[*channelSet]
+
+	// Global and channel emotes by ID, for lookups by image requests
+	index emoteIndex
+
+	health *healthTracker
+
+	// Optional cache shared with other replicas
+	shared SharedCache
 
-	mu sync.Mutex
+	mu sync.RWMutex
 }
 
-func NewEmoteStore() *EmoteStore {
+// NewEmoteStore creates an EmoteStore. Background channel refreshes are
+// cancelled once ctx is done.
+func NewEmoteStore(config *ProviderConfig, fetcher Fetcher, ctx context.Context) *EmoteStore {
+	if config == nil {
+		config = DefaultProviderConfig()
+	}
+	if fetcher == nil {
+		fetcher = NewHTTPFetcher(nil, DefaultFetcherOptions())
+	}
+
+	providers := []Provider{
+		NewBttvProvider(config.Bttv, fetcher),
+		NewFfzProvider(config.Ffz, fetcher),
+		NewSevenTVProvider(config.SevenTV, fetcher),
+	}
+
+	specificLimits := make(map[rune]*rateLimiter)
+	for _, p := range providers {
+		specificLimits[p.IdentifierCode()] = newRateLimiter(specificEmoteRate, specificEmoteBurst)
+	}
+
 	return &EmoteStore{
-		providers: []Provider{
-			&BttvProvider{},
-			&FfzProvider{},
-			&SevenTVProvider{},
-		},
+		ctx:            ctx,
+		providers:      providers,
 		globalEmotes:   make(ProviderEmotes),
-		danglingEmotes: make(ProviderEmotes),
-		channels:       make(map[string]ProviderEmotes),
-		channelTimes:   make(map[string]time.Time),
-		wordMaps:       make(map[string]WordMap),
+		danglingEmotes: newLRUCache[string, Emote](danglingEmoteCapacity),
+		specificLoads:  newFlightGroup[Emote](),
+		specificLimits: specificLimits,
+		channels:       make(map[string]*channelSet),
+		loads:          newFlightGroup[*channelSet](),
+		index:          make(emoteIndex),
+		health:         newHealthTracker(providers),
 	}
 }
 
-func (s *EmoteStore) Init() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Init loads the global emotes of every provider.
+//
+// Providers that fail are retried in the background until they succeed. An
+// error is only returned if every provider failed.
+func (s *EmoteStore) Init(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.providers))
+	for i, provider := range s.providers {
+		wg.Add(1)
+		go func(i int, provider Provider) {
+			defer wg.Done()
+			errs[i] = s.loadGlobals(ctx, provider)
+		}(i, provider)
+	}
+	wg.Wait()
 
-	for _, provider := range s.providers {
-		globals, err := provider.LoadGlobalEmotes()
-		if err != nil {
-			return err
+	var firstErr error
+	failed := 0
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		provider := s.providers[i]
+		log.Printf("Load %q global emotes: %v\n", provider.IdentifierCode(), err)
+		go s.retryGlobals(provider)
+
+		if firstErr == nil {
+			firstErr = err
 		}
-		s.globalEmotes[provider.IdentifierCode()] = globals
+		failed++
 	}
 
+	if failed == len(s.providers) {
+		return fmt.Errorf("load global emotes: %w", firstErr)
+	}
 	return nil
 }
 
-// LoadIfNotLoaded loads and caches BTTV and FFZ emotes for a channel
-func (s *EmoteStore) LoadIfNotLoaded(channelID string) error {
+func (s *EmoteStore) loadGlobals(ctx context.Context, provider Provider) error {
+	code := provider.IdentifierCode()
+	globals, err := provider.LoadGlobalEmotes(ctx)
+	s.health.record(code, err)
+	if err != nil {
+		return err
+	}
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if _, ok := s.channels[channelID]; ok { // already loaded
-		if time.Since(s.channelTimes[channelID]) > cachedEmoteDuration { // emotes are possibly out of date
-			delete(s.channels, channelID)
-			delete(s.channelTimes, channelID)
-		} else {
-			return nil
+	s.index.remove(ProviderEmotes{code: s.globalEmotes[code]})
+	s.index.add(ProviderEmotes{code: globals})
+	s.globalEmotes[code] = globals
+	s.mu.Unlock()
+	s.health.setGlobalsLoaded(code)
+	return nil
+}
+
+// retryGlobals retries loading a provider's global emotes until it succeeds,
+// then rebuilds the word maps of loaded channels.
+func (s *EmoteStore) retryGlobals(provider Provider) {
+	for failures := 1; ; failures++ {
+		if err := sleepContext(s.ctx, providerRetryDelay(failures)); err != nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(s.ctx, channelLoadTimeout)
+		err := s.loadGlobals(ctx, provider)
+		cancel()
+		if err != nil {
+			log.Printf("Retry %q global emotes: %v\n", provider.IdentifierCode(), err)
+			continue
 		}
+
+		s.rebuildWordMaps()
+		return
 	}
-	return s.load(channelID)
 }
 
-func (s *EmoteStore) Load(channelID string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.load(channelID)
+// rebuildWordMaps replaces the word maps of every loaded channel, e.g. after
+// the global emotes changed.
+func (s *EmoteStore) rebuildWordMaps() {
+	s.mu.RLock()
+	channels := make(map[string]*channelSet, len(s.channels))
+	for id, set := range s.channels {
+		channels[id] = set
+	}
+	s.mu.RUnlock()
+
+	for id, set := range channels {
+		updated := *set
+		updated.wordMap = s.buildWordMap(set.emotes)
+
+		s.mu.Lock()
+		if s.channels[id] == set { // don't clobber a concurrent reload
+			s.channels[id] = &updated
+		}
+		s.mu.Unlock()
+	}
 }
 
-func (s *EmoteStore) load(channelID string) error {
-	channelEmotes := make(ProviderEmotes)
-	for _, provider := range s.providers {
-		code := provider.IdentifierCode()
-		emotes, err := provider.LoadChannelEmotes(channelID)
-		if err != nil {
-			return err
+// Health returns the health of every provider.
+func (s *EmoteStore) Health() []ProviderHealth {
+	return s.health.snapshot()
+}
+
+// LoadIfNotLoaded loads and caches third party emotes for a channel.
+//
+// Only the first load of a channel blocks. If the channel's emotes are out of
+// date, they keep being served while a refresh runs in the background.
+func (s *EmoteStore) LoadIfNotLoaded(ctx context.Context, channelID string) error {
+	s.mu.RLock()
+	set, ok := s.channels[channelID]
+	s.mu.RUnlock()
+
+	if !ok {
+		return s.loadProviders(ctx, channelID, s.providers, false)
+	}
+
+	var providers []Provider
+	if time.Since(set.loaded) > cachedEmoteDuration { // emotes are possibly out of date
+		providers = s.providers
+	} else {
+		providers = set.dueRetries(s.providers)
+	}
+
+	if len(providers) > 0 {
+		go func() {
+			if err := s.loadProviders(s.ctx, channelID, providers, false); err != nil {
+				log.Printf("Refresh channel %q: %v\n", channelID, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Load (re)loads the emotes of a channel. Concurrent loads of the same
+// channel share a single set of provider requests, but never join a refresh
+// or retry of only some providers.
+//
+// If some providers fail, the emotes of the others are still stored and the
+// failed providers are retried later. The returned error describes the failures.
+func (s *EmoteStore) Load(ctx context.Context, channelID string) error {
+	return s.loadProviders(ctx, channelID, s.providers, true)
+}
+
+// loadProviders loads the given providers' emotes for a channel. Unless force
+// is set, a fresh set published by another replica may be used instead.
+func (s *EmoteStore) loadProviders(ctx context.Context, channelID string, providers []Provider, force bool) error {
+	set, err := s.loads.Do(ctx, loadKey(channelID, providers, force), func() (*channelSet, error) {
+		if s.shared != nil {
+			return s.loadShared(channelID, providers, force)
 		}
-		channelEmotes[code] = emotes
+		return s.load(channelID, providers)
+	})
+	if err != nil {
+		return err
 	}
 
-	s.channels[channelID] = channelEmotes
-	s.channelTimes[channelID] = time.Now()
-	s.updateWordMap(channelID)
+	var failed []string
+	for _, p := range providers {
+		if _, ok := set.failures[p.IdentifierCode()]; ok {
+			failed = append(failed, string(p.IdentifierCode()))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("providers %v failed to load", failed)
+	}
 	return nil
 }
 
-func (s *EmoteStore) GetChannelEmotes(channelID string) ([]Emote, bool) {
+// loadKey identifies a load of a channel, so that only loads of the same
+// providers with the same force flag are shared.
+func loadKey(channelID string, providers []Provider, force bool) string {
+	codes := make([]string, len(providers))
+	for i, p := range providers {
+		codes[i] = string(p.IdentifierCode())
+	}
+	sort.Strings(codes)
+
+	key := channelID + ":" + strings.Join(codes, "")
+	if force {
+		key += ":force"
+	}
+	return key
+}
+
+type providerResult struct {
+	code   rune
+	emotes []Emote
+	err    error
+}
+
+// load fetches the given providers' emotes for a channel and merges them with
+// the channel's existing emotes.
+func (s *EmoteStore) load(channelID string, providers []Provider) (*channelSet, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, channelLoadTimeout)
+	defer cancel()
+
+	results := make(chan providerResult, len(providers))
+	for _, provider := range providers {
+		go func(provider Provider) {
+			emotes, err := provider.LoadChannelEmotes(ctx, channelID)
+			results <- providerResult{
+				code:   provider.IdentifierCode(),
+				emotes: emotes,
+				err:    err,
+			}
+		}(provider)
+	}
+
+	collected := make([]providerResult, 0, len(providers))
+	for range providers {
+		res := <-results
+		s.health.record(res.code, res.err)
+		if res.err != nil {
+			log.Printf("Load %q emotes for channel %q: %v\n", res.code, channelID, res.err)
+		}
+		collected = append(collected, res)
+	}
+
+	set := s.mergeChannel(channelID, collected, len(providers) < len(s.providers))
+	for _, res := range collected {
+		if res.err != nil {
+			go s.retryChannelProvider(channelID, res.code, set.failures[res.code])
+		}
+	}
+	return set, nil
+}
+
+// mergeChannel replaces the emotes of the loaded providers in the current set
+// of a channel, keeping those of the other providers. Loads of other providers
+// may finish concurrently, so the set is rebuilt if it changed in the meantime.
+func (s *EmoteStore) mergeChannel(channelID string, results []providerResult, partial bool) *channelSet {
+	for {
+		s.mu.RLock()
+		previous := s.channels[channelID]
+		s.mu.RUnlock()
+
+		channelEmotes := make(ProviderEmotes)
+		failures := make(map[rune]*providerFailure)
+		loaded := time.Now()
+		if previous != nil {
+			// Start from the previous state, providers being loaded are overwritten below
+			for code, emotes := range previous.emotes {
+				channelEmotes[code] = emotes
+			}
+			for code, failure := range previous.failures {
+				failures[code] = failure
+			}
+			if partial { // partial retry, keep staleness of the others
+				loaded = previous.loaded
+			}
+		}
+
+		for _, res := range results {
+			if res.err != nil {
+				// Keep serving the previously loaded emotes of this provider, if any
+				failures[res.code] = newProviderFailure(failures[res.code])
+				continue
+			}
+			channelEmotes[res.code] = res.emotes
+			delete(failures, res.code)
+		}
+
+		set := &channelSet{
+			emotes:   channelEmotes,
+			wordMap:  s.buildWordMap(channelEmotes),
+			loaded:   loaded,
+			failures: failures,
+		}
+
+		s.mu.Lock()
+		if s.channels[channelID] != previous { // another load finished first
+			s.mu.Unlock()
+			continue
+		}
+		if previous != nil {
+			s.index.remove(previous.emotes)
+		}
+		s.index.add(set.emotes)
+		s.channels[channelID] = set
+		s.mu.Unlock()
+		return set
+	}
+}
+
+// retryChannelProvider reloads a provider that failed to load for a channel
+// once its retry is due. Nothing is done if the failure was superseded by
+// another load in the meantime. If the retry fails, load schedules the next one.
+func (s *EmoteStore) retryChannelProvider(channelID string, code rune, failure *providerFailure) {
+	if err := sleepContext(s.ctx, time.Until(failure.retryAt)); err != nil {
+		return
+	}
+
+	s.mu.RLock()
+	set, ok := s.channels[channelID]
+	s.mu.RUnlock()
+	if !ok || set.failures[code] != failure {
+		return
+	}
+
+	provider, ok := s.ProviderFromCode(code)
+	if !ok {
+		return
+	}
+	if err := s.loadProviders(s.ctx, channelID, []Provider{provider}, false); err != nil {
+		log.Printf("Retry channel %q: %v\n", channelID, err)
+	}
+}
+
+// putChannel replaces the emote set of a channel.
+func (s *EmoteStore) putChannel(channelID string, set *channelSet) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	e, ok := s.channels[channelID]
+
+	if current, ok := s.channels[channelID]; ok {
+		s.index.remove(current.emotes)
+	}
+	s.index.add(set.emotes)
+	s.channels[channelID] = set
+}
+
+// ApplyChange updates the emotes of a loaded channel with a change reported
+// by a live source, filling in the names of renamed and removed emotes. It
+// reports whether anything changed. Changes to channels that aren't loaded are
+// ignored, their next load picks them up.
+func (s *EmoteStore) ApplyChange(change *EmoteChange) bool {
+	if change.Kind == EmoteAdded && change.Emote == nil {
+		return false
+	}
+
+	for {
+		s.mu.RLock()
+		set, ok := s.channels[change.ChannelID]
+		s.mu.RUnlock()
+		if !ok {
+			return false
+		}
+
+		list := set.emotes[change.Provider]
+		updated := make([]Emote, 0, len(list)+1)
+		var previous Emote
+		for _, e := range list {
+			if e.EmoteID() != change.EmoteID {
+				updated = append(updated, e)
+				continue
+			}
+
+			previous = e
+			switch change.Kind {
+			case EmoteAdded:
+				updated = append(updated, change.Emote)
+			case EmoteRenamed:
+				r, ok := e.(renamer)
+				if !ok {
+					return false
+				}
+				updated = append(updated, r.withName(change.Name))
+			}
+		}
+
+		switch change.Kind {
+		case EmoteAdded:
+			if previous == nil {
+				updated = append(updated, change.Emote)
+			}
+			change.Name = change.Emote.TypedName()
+		case EmoteRemoved:
+			if previous == nil {
+				return false
+			}
+			change.Name = previous.TypedName()
+		case EmoteRenamed:
+			if previous == nil || previous.TypedName() == change.Name {
+				return false
+			}
+			change.OldName = previous.TypedName()
+		}
+
+		emotes := make(ProviderEmotes, len(set.emotes)+1)
+		for code, list := range set.emotes {
+			emotes[code] = list
+		}
+		emotes[change.Provider] = updated
+
+		next := &channelSet{
+			emotes:   emotes,
+			wordMap:  s.buildWordMap(emotes),
+			loaded:   set.loaded,
+			failures: set.failures,
+		}
+
+		s.mu.Lock()
+		if s.channels[change.ChannelID] != set { // reloaded concurrently, patch the new set
+			s.mu.Unlock()
+			continue
+		}
+		s.index.remove(set.emotes)
+		s.index.add(next.emotes)
+		s.channels[change.ChannelID] = next
+		s.mu.Unlock()
+
+		if s.shared != nil {
+			if err := s.publishChannel(change.ChannelID, next); err != nil {
+				log.Printf("Publish shared channel %q: %v\n", change.ChannelID, err)
+			}
+		}
+		return true
+	}
+}
+
+func (s *EmoteStore) GetChannelEmotes(channelID string) ([]Emote, bool) {
+	s.mu.RLock()
+	set, ok := s.channels[channelID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
 
 	var emotes []Emote
-	for _, v := range e {
+	for _, v := range set.emotes {
 		emotes = append(emotes, v...)
 	}
 
-	return emotes, ok
+	return emotes, true
 }
 
 func (s *EmoteStore) ProviderFromCode(identifierCode rune) (Provider, bool) {
@@ -119,54 +550,57 @@ func (s *EmoteStore) ProviderFromCode(identifierCode rune) (Provider, bool) {
 	return nil, false
 }
 
-func (s *EmoteStore) GetEmote(identifierCode rune, emoteID string) (Emote, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// GetEmote finds an emote by its provider and ID. Emotes that aren't part of
+// any loaded global or channel set are requested from the provider, subject
+// to a rate limit, and cached for a while.
+func (s *EmoteStore) GetEmote(ctx context.Context, identifierCode rune, emoteID string) (Emote, bool) {
+	s.mu.RLock()
+	e, found := s.index.get(identifierCode, emoteID)
+	s.mu.RUnlock()
+	if found {
+		return e, true
+	}
 
-	if globalList, ok := s.globalEmotes[identifierCode]; !ok {
+	provider, ok := s.ProviderFromCode(identifierCode)
+	if !ok {
 		return nil, false
-	} else {
-		// Check the provider's global emotes
-		for _, e := range globalList {
-			if e.EmoteID() == emoteID {
-				return e, true
-			}
-		}
 	}
 
-	for _, channel := range s.channels {
-		if channelList, ok := channel[identifierCode]; !ok {
-			return nil, false
-		} else {
-			// Check the provider's channel emotes
-			for _, e := range channelList {
-				if e.EmoteID() == emoteID {
-					return e, true
-				}
-			}
-		}
+	key := string(identifierCode) + emoteID
+	if e, ok := s.danglingEmotes.Get(key); ok {
+		return e, e != nil
 	}
 
-	provider, ok := s.ProviderFromCode(identifierCode)
-	if !ok {
+	if limiter := s.specificLimits[identifierCode]; !limiter.Allow() {
+		if n, ok := limiter.Reject(rateLimitReportInterval); ok {
+			log.Printf("Rate limited %d lookups of %q emotes, last %q\n", n, identifierCode, emoteID)
+		}
 		return nil, false
 	}
 
-	e, err := provider.LoadSpecificEmote(emoteID)
-	if err != nil {
+	e, err := s.specificLoads.Do(ctx, key, func() (Emote, error) {
+		ctx, cancel := context.WithTimeout(s.ctx, channelLoadTimeout)
+		defer cancel()
+		return provider.LoadSpecificEmote(ctx, emoteID)
+	})
+	if errors.Is(err, ErrNotFound) {
+		s.danglingEmotes.Add(key, nil, unknownEmoteDuration)
+		return nil, false
+	} else if err != nil {
 		return nil, false
-	} else {
-		s.danglingEmotes[identifierCode] = append(s.danglingEmotes[identifierCode], e)
-		return e, true
 	}
+
+	s.danglingEmotes.Add(key, e, danglingEmoteDuration)
+	return e, true
 }
 
-func (s *EmoteStore) updateWordMap(channelID string) {
+func (s *EmoteStore) buildWordMap(channelEmotes ProviderEmotes) WordMap {
 	// Word map priority is the order of providers.
 	// Work in reverse order so later ones override earlier ones!
 
 	wordMap := make(WordMap)
 
+	s.mu.RLock()
 	for i := len(s.providers) - 1; i >= 0; i-- {
 		identifierCode := s.providers[i].IdentifierCode()
 		emotes, ok := s.globalEmotes[identifierCode]
@@ -178,34 +612,32 @@ func (s *EmoteStore) updateWordMap(channelID string) {
 			wordMap[e.TypedName()] = e
 		}
 	}
+	s.mu.RUnlock()
 
-	channelEmotes, ok := s.channels[channelID]
-	if ok {
-		for i := len(s.providers) - 1; i >= 0; i-- {
-			identifierCode := s.providers[i].IdentifierCode()
-			emotes, ok := channelEmotes[identifierCode]
-			if !ok {
-				continue
-			}
+	for i := len(s.providers) - 1; i >= 0; i-- {
+		identifierCode := s.providers[i].IdentifierCode()
+		emotes, ok := channelEmotes[identifierCode]
+		if !ok {
+			continue
+		}
 
-			for _, e := range emotes {
-				wordMap[e.TypedName()] = e
-			}
+		for _, e := range emotes {
+			wordMap[e.TypedName()] = e
 		}
 	}
 
-	s.wordMaps[channelID] = wordMap
+	return wordMap
 }
 
 func (s *EmoteStore) GetEmoteFromWord(word, channelID string) (Emote, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	channelWords, ok := s.wordMaps[channelID]
+	s.mu.RLock()
+	set, ok := s.channels[channelID]
+	s.mu.RUnlock()
 	if !ok {
 		return nil, false
 	}
 
-	emote, ok := channelWords[word]
+	emote, ok := set.wordMap[word]
 	if !ok {
 		return nil, false
 	}
@@ -0,0 +1,371 @@
+package emotes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testChannelID = "1"
+
+// fakeProvider serves canned API responses for one provider and fails with
+// 503 while failing is set.
+type fakeProvider struct {
+	*httptest.Server
+	responses map[string]string
+	failing   int32
+
+	// Requests wait for gate to be closed while it is set, after being
+	// reported on held
+	gate chan struct{}
+	held chan string
+	mu   sync.Mutex
+}
+
+func newFakeProvider(t *testing.T, responses map[string]string) *fakeProvider {
+	p := &fakeProvider{responses: responses, held: make(chan string, 16)}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		gate := p.gate
+		p.mu.Unlock()
+		if gate != nil {
+			p.held <- r.URL.Path
+			<-gate
+		}
+
+		if atomic.LoadInt32(&p.failing) != 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		p.mu.Lock()
+		body, ok := p.responses[r.URL.Path]
+		p.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// hold makes requests wait until the returned function is called, or the
+// test ends.
+func (p *fakeProvider) hold(t *testing.T) func() {
+	gate := make(chan struct{})
+	p.mu.Lock()
+	p.gate = gate
+	p.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			p.mu.Lock()
+			p.gate = nil
+			p.mu.Unlock()
+			close(gate)
+		})
+	}
+	t.Cleanup(release)
+	return release
+}
+
+func (p *fakeProvider) setResponse(path, body string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.responses[path] = body
+}
+
+func (p *fakeProvider) setFailing(failing bool) {
+	var v int32
+	if failing {
+		v = 1
+	}
+	atomic.StoreInt32(&p.failing, v)
+}
+
+// newFakeProviders starts fake BTTV, FFZ and 7TV APIs, each with one global
+// and one channel emote for testChannelID.
+func newFakeProviders(t *testing.T) map[rune]*fakeProvider {
+	return map[rune]*fakeProvider{
+		'b': newFakeProvider(t, map[string]string{
+			"/cached/emotes/global":                 `[{"id":"bg","code":"BttvGlobal","imageType":"png"}]`,
+			"/cached/users/twitch/" + testChannelID: `{"channelEmotes":[{"id":"bc","code":"BttvChannel","imageType":"png"}],"sharedEmotes":[]}`,
+		}),
+		'f': newFakeProvider(t, map[string]string{
+			"/set/global":               `{"default_sets":[3],"sets":{"3":{"emoticons":[{"id":1,"name":"FfzGlobal"}]}}}`,
+			"/room/id/" + testChannelID: `{"room":{"set":7},"sets":{"7":{"emoticons":[{"id":2,"name":"FfzChannel"}]}}}`,
+		}),
+		's': newFakeProvider(t, map[string]string{
+			"/emote-sets/global":             `{"id":"global","emotes":[{"id":"sg","name":"SevenGlobal"}]}`,
+			"/users/twitch/" + testChannelID: `{"emote_set":{"id":"set","emotes":[{"id":"sc","name":"SevenChannel"}]}}`,
+		}),
+	}
+}
+
+// testProviderWords are the global and channel emote words of each fake provider.
+var testProviderWords = map[rune][]string{
+	'b': {"BttvGlobal", "BttvChannel"},
+	'f': {"FfzGlobal", "FfzChannel"},
+	's': {"SevenGlobal", "SevenChannel"},
+}
+
+func newTestStore(t *testing.T, providers map[rune]*fakeProvider) *EmoteStore {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	config := &ProviderConfig{
+		Bttv:    ProviderEndpoints{APIBase: providers['b'].URL},
+		Ffz:     ProviderEndpoints{APIBase: providers['f'].URL},
+		SevenTV: ProviderEndpoints{APIBase: providers['s'].URL},
+	}
+	opts := DefaultFetcherOptions()
+	opts.MaxRetries = 0
+	return NewEmoteStore(config, NewHTTPFetcher(nil, opts), ctx)
+}
+
+func providerHealth(s *EmoteStore, code rune) ProviderHealth {
+	for _, h := range s.Health() {
+		if h.Provider == string(code) {
+			return h
+		}
+	}
+	return ProviderHealth{}
+}
+
+func TestEmoteStoreProviderFailure(t *testing.T) {
+	for _, failing := range []rune{'b', 'f', 's'} {
+		t.Run(string(failing), func(t *testing.T) {
+			providers := newFakeProviders(t)
+			providers[failing].setFailing(true)
+			store := newTestStore(t, providers)
+
+			if err := store.Init(context.Background()); err != nil {
+				t.Fatalf("Init: %v", err)
+			}
+
+			err := store.LoadIfNotLoaded(context.Background(), testChannelID)
+			if err == nil || !strings.Contains(err.Error(), string(failing)) {
+				t.Fatalf("LoadIfNotLoaded error = %v, want failure of %q", err, failing)
+			}
+
+			for code, words := range testProviderWords {
+				for _, word := range words {
+					_, ok := store.GetEmoteFromWord(word, testChannelID)
+					if want := code != failing; ok != want {
+						t.Errorf("GetEmoteFromWord(%q) found = %v, want %v", word, ok, want)
+					}
+				}
+			}
+
+			for code := range providers {
+				h := providerHealth(store, code)
+				if want := code != failing; h.Healthy != want || h.GlobalsLoaded != want {
+					t.Errorf("health of %q = %+v, want healthy and loaded = %v", code, h, want)
+				}
+				if code == failing && (h.ConsecutiveFailures == 0 || h.LastError == "") {
+					t.Errorf("health of %q = %+v, want recorded failure", code, h)
+				}
+			}
+		})
+	}
+}
+
+func TestEmoteStoreAllProvidersFailing(t *testing.T) {
+	providers := newFakeProviders(t)
+	for _, p := range providers {
+		p.setFailing(true)
+	}
+	store := newTestStore(t, providers)
+
+	err := store.Init(context.Background())
+	if !errors.Is(err, ErrUpstreamUnavailable) {
+		t.Fatalf("Init error = %v, want ErrUpstreamUnavailable", err)
+	}
+}
+
+func TestEmoteStoreRetryChannelProvider(t *testing.T) {
+	providers := newFakeProviders(t)
+	store := newTestStore(t, providers)
+	if err := store.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	providers['s'].setFailing(true)
+	if err := store.Load(context.Background(), testChannelID); err == nil {
+		t.Fatal("Load succeeded with a failing provider")
+	}
+	providers['s'].setFailing(false)
+
+	// Make the failure due now instead of waiting for the scheduled retry
+	store.mu.Lock()
+	set := *store.channels[testChannelID]
+	failure := &providerFailure{count: 1, retryAt: time.Now()}
+	set.failures = map[rune]*providerFailure{'s': failure}
+	store.channels[testChannelID] = &set
+	store.mu.Unlock()
+
+	store.retryChannelProvider(testChannelID, 's', failure)
+
+	if _, ok := store.GetEmoteFromWord("SevenChannel", testChannelID); !ok {
+		t.Error("channel emote of retried provider is missing")
+	}
+	if _, ok := store.GetEmoteFromWord("BttvChannel", testChannelID); !ok {
+		t.Error("channel emote of other provider is missing after retry")
+	}
+	if h := providerHealth(store, 's'); !h.Healthy {
+		t.Errorf("health after retry = %+v, want healthy", h)
+	}
+}
+
+func TestEmoteStoreLoadDuringProviderRetry(t *testing.T) {
+	providers := newFakeProviders(t)
+	store := newTestStore(t, providers)
+	if err := store.LoadIfNotLoaded(context.Background(), testChannelID); err != nil {
+		t.Fatalf("LoadIfNotLoaded: %v", err)
+	}
+	bttv, _ := store.ProviderFromCode('b')
+
+	// Start a retry of BTTV alone and keep it pending
+	release := providers['b'].hold(t)
+	retried := make(chan error, 1)
+	go func() {
+		retried <- store.loadProviders(context.Background(), testChannelID, []Provider{bttv}, false)
+	}()
+	select {
+	case <-providers['b'].held:
+	case <-time.After(time.Second * 5):
+		t.Fatal("retry didn't request BTTV")
+	}
+
+	// A reload must request every provider rather than join the retry
+	providers['f'].setResponse("/room/id/"+testChannelID, `{"room":{"set":7},"sets":{"7":{"emoticons":[{"id":3,"name":"FfzNew"}]}}}`)
+	providers['s'].setResponse("/users/twitch/"+testChannelID, `{"emote_set":{"id":"set","emotes":[{"id":"sn","name":"SevenNew"}]}}`)
+	loaded := make(chan error, 1)
+	go func() {
+		loaded <- store.Load(context.Background(), testChannelID)
+	}()
+	select {
+	case <-providers['b'].held:
+	case <-time.After(time.Second * 5):
+		t.Fatal("reload didn't request BTTV")
+	}
+	release()
+
+	if err := <-retried; err != nil {
+		t.Errorf("retry: %v", err)
+	}
+	if err := <-loaded; err != nil {
+		t.Errorf("Load: %v", err)
+	}
+
+	for word, want := range map[string]bool{
+		"BttvChannel":  true,
+		"FfzNew":       true,
+		"FfzChannel":   false,
+		"SevenNew":     true,
+		"SevenChannel": false,
+	} {
+		if _, ok := store.GetEmoteFromWord(word, testChannelID); ok != want {
+			t.Errorf("GetEmoteFromWord(%q) found = %v, want %v", word, ok, want)
+		}
+	}
+}
+
+const (
+	benchmarkChannels         = 5000
+	benchmarkEmotesPerChannel = 50
+)
+
+// newBenchmarkStore returns a store with thousands of synthetic channel sets
+// loaded, each with its own BTTV emotes and a share of common 7TV emotes.
+func newBenchmarkStore(b *testing.B) *EmoteStore {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(cancel)
+	store := NewEmoteStore(nil, nil, ctx)
+
+	for c := 0; c < benchmarkChannels; c++ {
+		channelID := strconv.Itoa(c)
+		emotes := make(ProviderEmotes)
+		for i := 0; i < benchmarkEmotesPerChannel; i++ {
+			emotes['b'] = append(emotes['b'], &BttvEmote{
+				ID:        fmt.Sprintf("b%d_%d", c, i),
+				Code:      fmt.Sprintf("Bttv%d", i),
+				ImageType: "png",
+			})
+			emotes['s'] = append(emotes['s'], &SevenTVEmote{
+				ID:   fmt.Sprintf("s%d", (c+i)%1000),
+				Name: fmt.Sprintf("Seven%d", i),
+			})
+		}
+
+		store.putChannel(channelID, &channelSet{
+			emotes:  emotes,
+			wordMap: store.buildWordMap(emotes),
+			loaded:  time.Now(),
+		})
+	}
+	return store
+}
+
+func BenchmarkGetEmote(b *testing.B) {
+	store := newBenchmarkStore(b)
+	ctx := context.Background()
+
+	b.Run("Serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			id := fmt.Sprintf("b%d_%d", i%benchmarkChannels, i%benchmarkEmotesPerChannel)
+			if _, ok := store.GetEmote(ctx, 'b', id); !ok {
+				b.Fatalf("emote %q not found", id)
+			}
+		}
+	})
+
+	b.Run("Parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				id := "s" + strconv.Itoa(i%1000)
+				if _, ok := store.GetEmote(ctx, 's', id); !ok {
+					b.Fatalf("emote %q not found", id)
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkGetEmoteFromWord(b *testing.B) {
+	store := newBenchmarkStore(b)
+
+	b.Run("Serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			channelID := strconv.Itoa(i % benchmarkChannels)
+			word := "Bttv" + strconv.Itoa(i%benchmarkEmotesPerChannel)
+			if _, ok := store.GetEmoteFromWord(word, channelID); !ok {
+				b.Fatalf("word %q not found in channel %q", word, channelID)
+			}
+		}
+	})
+
+	b.Run("Parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				channelID := strconv.Itoa(i % benchmarkChannels)
+				word := "Seven" + strconv.Itoa(i%benchmarkEmotesPerChannel)
+				if _, ok := store.GetEmoteFromWord(word, channelID); !ok {
+					b.Fatalf("word %q not found in channel %q", word, channelID)
+				}
+			}
+		})
+	})
+}
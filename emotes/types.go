@@ -13,6 +13,6 @@ type Emote interface {
 	// LetterCode returns the provider prefix letter code.
 	LetterCode() string
 
-	// Type returns the emote type/mimetype of the image.
+	// Type returns the normalized MIME type of the image, see NormalizeMimeType.
 	Type() string
 }
@@ -0,0 +1,320 @@
+package emotes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/image/webp"
+	"image"
+	"image/draw"
+)
+
+// The x/image/webp decoder only understands still images made of a single
+// VP8L chunk, a single VP8 chunk, or an alpha-only VP8X header followed by
+// ALPH and VP8 chunks. To decode anything else, including animations, the
+// container is parsed here and each frame's bitstream is rewrapped in one of
+// those forms.
+
+const (
+	webpAnimationFlag = 1 << 1
+	webpAlphaFlag     = 1 << 4
+
+	webpVP8XSize      = 10
+	webpANIMSize      = 6
+	webpANMFHeaderLen = 16
+
+	webpDisposeFlag = 1 << 0
+	webpNoBlendFlag = 1 << 1
+)
+
+var errInvalidWebP = errors.New("invalid webp")
+
+type webpChunk struct {
+	id   string
+	data []byte
+}
+
+// decodeWebP decodes a still or animated WebP image. Only the first frame of
+// an animation is decoded unless animated is set.
+func decodeWebP(data []byte, animated bool) (*animation, error) {
+	chunks, err := readWebPChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if chunks[0].id != "VP8X" {
+		img, err := decodeWebPFrame(chunks, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		return staticAnimation(img), nil
+	}
+
+	flags, width, height, err := parseVP8X(chunks[0].data)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&webpAnimationFlag == 0 {
+		if err := checkWebPCanvas(width, height, 1); err != nil {
+			return nil, err
+		}
+		img, err := decodeWebPFrame(chunks[1:], width, height)
+		if err != nil {
+			return nil, err
+		}
+		return staticAnimation(img), nil
+	}
+
+	return decodeWebPAnimation(chunks[1:], width, height, animated)
+}
+
+// decodeWebPConfig returns the canvas size of a still or animated WebP image.
+func decodeWebPConfig(data []byte) (image.Config, error) {
+	chunks, err := readWebPChunks(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	if chunks[0].id == "VP8X" {
+		_, width, height, err := parseVP8X(chunks[0].data)
+		if err != nil {
+			return image.Config{}, err
+		}
+		return image.Config{Width: width, Height: height}, nil
+	}
+
+	return webp.DecodeConfig(bytes.NewReader(data))
+}
+
+// checkWebPCanvas rejects canvases that are too large to allocate for frames
+// frames.
+func checkWebPCanvas(width, height, frames int) error {
+	if err := checkCanvas(width, height, frames); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidWebP, err)
+	}
+	return nil
+}
+
+func decodeWebPAnimation(chunks []webpChunk, width, height int, animated bool) (*animation, error) {
+	frames := 1
+	if animated {
+		frames = 0
+		for _, chunk := range chunks {
+			if chunk.id == "ANMF" {
+				frames++
+			}
+		}
+	}
+	if err := checkWebPCanvas(width, height, frames); err != nil {
+		return nil, err
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	res := &animation{}
+
+	for _, chunk := range chunks {
+		switch chunk.id {
+		case "ANIM":
+			if len(chunk.data) < webpANIMSize {
+				return nil, fmt.Errorf("%w: short ANIM chunk", errInvalidWebP)
+			}
+			res.loopCount = gifLoopCount(int(binary.LittleEndian.Uint16(chunk.data[4:6])))
+
+		case "ANMF":
+			if len(chunk.data) < webpANMFHeaderLen {
+				return nil, fmt.Errorf("%w: short ANMF chunk", errInvalidWebP)
+			}
+			h := chunk.data
+			x, y := 2*int(uint24(h[0:3])), 2*int(uint24(h[3:6]))
+			frameWidth, frameHeight := int(uint24(h[6:9]))+1, int(uint24(h[9:12]))+1
+			duration := int(uint24(h[12:15]))
+			flags := h[15]
+
+			rect := image.Rect(x, y, x+frameWidth, y+frameHeight)
+			if !rect.In(canvas.Bounds()) {
+				return nil, fmt.Errorf("%w: frame %d at %v outside of %dx%d canvas", errInvalidWebP, len(res.frames), rect, width, height)
+			}
+
+			frameChunks, err := parseWebPChunks(chunk.data[webpANMFHeaderLen:])
+			if err != nil {
+				return nil, err
+			}
+			frame, err := decodeWebPFrame(frameChunks, frameWidth, frameHeight)
+			if err != nil {
+				return nil, fmt.Errorf("frame %d: %w", len(res.frames), err)
+			}
+
+			op := draw.Over
+			if flags&webpNoBlendFlag != 0 {
+				op = draw.Src
+			}
+			draw.Draw(canvas, rect, frame, frame.Bounds().Min, op)
+
+			res.frames = append(res.frames, cloneRGBA(canvas))
+			res.delays = append(res.delays, (duration+5)/10) // milliseconds to 100ths of a second
+			if !animated {
+				return res, nil
+			}
+
+			if flags&webpDisposeFlag != 0 {
+				draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	if len(res.frames) == 0 {
+		return nil, fmt.Errorf("%w: animation without frames", errInvalidWebP)
+	}
+	return res, nil
+}
+
+// gifLoopCount converts a WebP loop count, the total number of times an
+// animation plays, to the GIF convention.
+func gifLoopCount(n int) int {
+	switch n {
+	case 0: // forever
+		return 0
+	case 1:
+		return -1
+	default:
+		return n - 1
+	}
+}
+
+// decodeWebPFrame decodes the ALPH, VP8 and VP8L chunks of a single image of
+// the given size, or of any size if width and height are zero. Other chunks
+// are ignored.
+func decodeWebPFrame(chunks []webpChunk, width, height int) (image.Image, error) {
+	var alph, vp8, vp8l *webpChunk
+	for i := range chunks {
+		switch chunks[i].id {
+		case "ALPH":
+			alph = &chunks[i]
+		case "VP8 ":
+			vp8 = &chunks[i]
+		case "VP8L":
+			vp8l = &chunks[i]
+		}
+	}
+
+	// The decoder allocates the image according to the size in the
+	// bitstream, so check it before decoding
+	bitstream := vp8l
+	if bitstream == nil {
+		bitstream = vp8
+	}
+	if bitstream == nil {
+		return nil, fmt.Errorf("%w: no image data", errInvalidWebP)
+	}
+	file := buildWebP(*bitstream)
+	cfg, err := webp.DecodeConfig(bytes.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	if width != 0 && height != 0 && (cfg.Width != width || cfg.Height != height) {
+		return nil, fmt.Errorf("%w: %dx%d image in %dx%d frame", errInvalidWebP, cfg.Width, cfg.Height, width, height)
+	}
+	if err := checkWebPCanvas(cfg.Width, cfg.Height, 1); err != nil {
+		return nil, err
+	}
+
+	if vp8l == nil && alph != nil {
+		if width == 0 || height == 0 {
+			return nil, fmt.Errorf("%w: alpha without canvas size", errInvalidWebP)
+		}
+		header := make([]byte, webpVP8XSize)
+		header[0] = webpAlphaFlag
+		putUint24(header[4:7], uint32(width-1))
+		putUint24(header[7:10], uint32(height-1))
+		file = buildWebP(webpChunk{id: "VP8X", data: header}, *alph, *vp8)
+	}
+
+	return webp.Decode(bytes.NewReader(file))
+}
+
+func parseVP8X(data []byte) (flags byte, width, height int, err error) {
+	if len(data) < webpVP8XSize {
+		return 0, 0, 0, fmt.Errorf("%w: short VP8X chunk", errInvalidWebP)
+	}
+	return data[0], int(uint24(data[4:7])) + 1, int(uint24(data[7:10])) + 1, nil
+}
+
+// readWebPChunks returns the chunks of a WebP file.
+func readWebPChunks(data []byte) ([]webpChunk, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("%w: bad header", errInvalidWebP)
+	}
+
+	size := int(binary.LittleEndian.Uint32(data[4:8]))
+	if size < 4 || size > len(data)-8 {
+		return nil, fmt.Errorf("%w: bad size", errInvalidWebP)
+	}
+
+	chunks, err := parseWebPChunks(data[12 : 8+size])
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("%w: no chunks", errInvalidWebP)
+	}
+	return chunks, nil
+}
+
+// parseWebPChunks splits data into RIFF chunks.
+func parseWebPChunks(data []byte) ([]webpChunk, error) {
+	var chunks []webpChunk
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("%w: truncated chunk header", errInvalidWebP)
+		}
+
+		id := string(data[0:4])
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		if size < 0 || size > len(data)-8 {
+			return nil, fmt.Errorf("%w: truncated %q chunk", errInvalidWebP, id)
+		}
+		chunks = append(chunks, webpChunk{id: id, data: data[8 : 8+size]})
+
+		// Chunks are padded to an even size
+		next := 8 + size + size%2
+		if next > len(data) {
+			next = len(data)
+		}
+		data = data[next:]
+	}
+	return chunks, nil
+}
+
+// buildWebP assembles chunks into a WebP file.
+func buildWebP(chunks ...webpChunk) []byte {
+	size := 4
+	for _, chunk := range chunks {
+		size += 8 + len(chunk.data) + len(chunk.data)%2
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 8+size))
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, uint32(size))
+	buf.WriteString("WEBP")
+	for _, chunk := range chunks {
+		buf.WriteString(chunk.id)
+		binary.Write(buf, binary.LittleEndian, uint32(len(chunk.data)))
+		buf.Write(chunk.data)
+		if len(chunk.data)%2 == 1 {
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes()
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
@@ -0,0 +1,253 @@
+package emotes
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"golang.org/x/image/webp"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// The still fixtures in testdata/webp come from the golang.org/x/image test
+// data. animated.webp combines three of its lossless gopher images on a
+// 152x100 canvas: the first frame is blended and disposed to the background,
+// the second isn't blended and the third is blended over the second.
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+const webpTestdata = "testdata/webp"
+
+func TestDecodeWebPGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames int
+		delays []int
+	}{
+		{name: "lossy", frames: 1},
+		{name: "lossless", frames: 1},
+		{name: "lossy-alpha", frames: 1},
+		{name: "animated", frames: 3, delays: []int{10, 5, 20}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.Join(webpTestdata, tt.name+".webp"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			anim, err := decodeWebP(data, true)
+			if err != nil {
+				t.Fatalf("decodeWebP: %v", err)
+			}
+			if len(anim.frames) != tt.frames {
+				t.Fatalf("decoded %d frames, want %d", len(anim.frames), tt.frames)
+			}
+			if tt.delays != nil && fmt.Sprint(anim.delays) != fmt.Sprint(tt.delays) {
+				t.Errorf("delays = %v, want %v", anim.delays, tt.delays)
+			}
+
+			if !anim.animated() {
+				// Still images must match the x/image decoder on its own
+				direct, err := webp.Decode(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("webp.Decode: %v", err)
+				}
+				if !imagesEqual(toNRGBA(anim.frames[0]), toNRGBA(direct)) {
+					t.Error("decoded image differs from webp.Decode")
+				}
+			}
+
+			for i, frame := range anim.frames {
+				checkGoldenImage(t, fmt.Sprintf("%s.frame%d.png", tt.name, i), toNRGBA(frame))
+			}
+
+			encoded, err := encodeAnimation(anim)
+			if err != nil {
+				t.Fatalf("encodeAnimation: %v", err)
+			}
+			if anim.animated() {
+				checkGoldenGif(t, tt.name+".golden.gif", encoded)
+			} else {
+				img, err := png.Decode(bytes.NewReader(encoded))
+				if err != nil {
+					t.Fatalf("decode transcoded png: %v", err)
+				}
+				checkGoldenImage(t, tt.name+".golden.png", toNRGBA(img))
+			}
+
+			still, err := decodeWebP(data, false)
+			if err != nil {
+				t.Fatalf("decodeWebP without animation: %v", err)
+			}
+			if len(still.frames) != 1 || !imagesEqual(toNRGBA(still.frames[0]), toNRGBA(anim.frames[0])) {
+				t.Error("still decode doesn't match the first frame")
+			}
+		})
+	}
+}
+
+func TestDecodeWebPConfig(t *testing.T) {
+	for name, want := range map[string]image.Point{
+		"lossy":       {150, 100},
+		"lossless":    {75, 100},
+		"lossy-alpha": {400, 301},
+		"animated":    {152, 100},
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(webpTestdata, name+".webp"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := decodeWebPConfig(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if cfg.Width != want.X || cfg.Height != want.Y {
+			t.Errorf("%s: size = %dx%d, want %v", name, cfg.Width, cfg.Height, want)
+		}
+	}
+}
+
+func TestDecodeWebPInvalid(t *testing.T) {
+	animated, err := ioutil.ReadFile(filepath.Join(webpTestdata, "animated.webp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := readWebPChunks(animated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vp8x := func(flags byte, width, height int) webpChunk {
+		data := make([]byte, webpVP8XSize)
+		data[0] = flags
+		putUint24(data[4:7], uint32(width-1))
+		putUint24(data[7:10], uint32(height-1))
+		return webpChunk{id: "VP8X", data: data}
+	}
+	// withFrame returns the animation with the header of its first frame changed
+	withFrame := func(change func(h []byte)) []byte {
+		frame := append([]byte(nil), chunks[2].data...)
+		change(frame)
+		return buildWebP(chunks[0], chunks[1], webpChunk{id: "ANMF", data: frame})
+	}
+	anim := webpChunk{id: "ANIM", data: make([]byte, webpANIMSize)}
+
+	tests := map[string][]byte{
+		"HugeAnimatedCanvas": buildWebP(vp8x(webpAnimationFlag, 0x1000000, 0x1000000), anim),
+		"HugeStillCanvas":    buildWebP(vp8x(0, 0x1000000, 0x1000000), chunks[2]),
+		"TooManyFrames": buildWebP(vp8x(webpAnimationFlag, maxCanvasSide, maxCanvasSide), anim,
+			chunks[2], chunks[2], chunks[2]),
+		"FrameOutsideCanvas": withFrame(func(h []byte) {
+			putUint24(h[0:3], 40) // x = 80, 75 pixels wide
+		}),
+		"FrameSizeMismatch": withFrame(func(h []byte) {
+			putUint24(h[6:9], 49) // 50 pixels wide, the bitstream is 75
+		}),
+		"Truncated": animated[:len(animated)/2],
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := decodeWebP(data, true)
+			if !errors.Is(err, errInvalidWebP) {
+				t.Errorf("decodeWebP error = %v, want errInvalidWebP", err)
+			}
+
+			_, err = decodeImage(&SevenTVEmote{ID: name}, MimeTypeWebP, data, true)
+			if !errors.Is(err, ErrDecode) {
+				t.Errorf("decodeImage error = %v, want ErrDecode", err)
+			}
+		})
+	}
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	res := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			res.SetNRGBA(x-bounds.Min.X, y-bounds.Min.Y, color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA))
+		}
+	}
+	return res
+}
+
+func imagesEqual(a, b *image.NRGBA) bool {
+	return a.Rect.Eq(b.Rect) && bytes.Equal(a.Pix, b.Pix)
+}
+
+// checkGoldenImage compares img to a golden PNG, or writes it with -update.
+func checkGoldenImage(t *testing.T, name string, img *image.NRGBA) {
+	t.Helper()
+	path := filepath.Join(webpTestdata, name)
+
+	if *updateGolden {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode %s: %v", name, err)
+	}
+	if !imagesEqual(img, toNRGBA(golden)) {
+		t.Errorf("image differs from %s", name)
+	}
+}
+
+// checkGoldenGif compares the frames, delays and loop count of an encoded GIF
+// to a golden GIF, or writes it with -update.
+func checkGoldenGif(t *testing.T, name string, data []byte) {
+	t.Helper()
+	path := filepath.Join(webpTestdata, name)
+
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	goldenData, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, err := gif.DecodeAll(bytes.NewReader(goldenData))
+	if err != nil {
+		t.Fatalf("decode %s: %v", name, err)
+	}
+	got, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode transcoded gif: %v", err)
+	}
+
+	if len(got.Image) != len(golden.Image) {
+		t.Fatalf("transcoded %d frames, want %d", len(got.Image), len(golden.Image))
+	}
+	if fmt.Sprint(got.Delay) != fmt.Sprint(golden.Delay) || got.LoopCount != golden.LoopCount {
+		t.Errorf("delays = %v, loop count = %d, want %v, %d", got.Delay, got.LoopCount, golden.Delay, golden.LoopCount)
+	}
+	for i := range got.Image {
+		if !imagesEqual(toNRGBA(got.Image[i]), toNRGBA(golden.Image[i])) {
+			t.Errorf("frame %d differs from %s", i, name)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package tme
+
+import (
+	"encoding/json"
+	"github.com/dnsge/twitch-mobile-emotes/emotes"
+	"log"
+	"net/http"
+)
+
+const healthPath = "/_tme/health"
+
+type healthResponse struct {
+	Healthy   bool                    `json:"healthy"`
+	Providers []emotes.ProviderHealth `json:"providers"`
+}
+
+// handleHealthRequest reports the health of each emote provider. The response
+// status is 503 if no provider has loaded its global emotes.
+func handleHealthRequest(w http.ResponseWriter, r *http.Request, store *emotes.EmoteStore) {
+	res := healthResponse{
+		Providers: store.Health(),
+	}
+	for _, p := range res.Providers {
+		if p.GlobalsLoaded {
+			res.Healthy = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("Error writing health response: %v\n", err)
+	}
+}
@@ -1,12 +1,22 @@
 package tme
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/dnsge/twitch-mobile-emotes/emotes"
 	"github.com/dnsge/twitch-mobile-emotes/session"
 	"log"
 	"net/http"
 	"strings"
+	"time"
+)
+
+const (
+	// Emote images don't change once uploaded
+	emoteMaxAge = time.Hour * 24 * 7
+	// Redirects point at provider CDNs, which may be reconfigured
+	redirectMaxAge = time.Hour
 )
 
 func getSizeFromString(text string) (emotes.ImageSize, error) {
@@ -22,7 +32,7 @@ func getSizeFromString(text string) (emotes.ImageSize, error) {
 	}
 }
 
-func handleEmoticonRequest(w http.ResponseWriter, r *http.Request, store *emotes.EmoteStore, cache *emotes.ImageFileCache) {
+func handleEmoticonRequest(w http.ResponseWriter, r *http.Request, store *emotes.EmoteStore, cache emotes.ImageCache) {
 	// URL comes in format of "/emoticons/<version>/...
 	if strings.HasPrefix(r.URL.Path, "/emoticons/v1/") {
 		// URL is in format of "/emoticons/v1/<id>/<size>"
@@ -36,7 +46,7 @@ func handleEmoticonRequest(w http.ResponseWriter, r *http.Request, store *emotes
 	}
 }
 
-func v1Handler(w http.ResponseWriter, r *http.Request, store *emotes.EmoteStore, cache *emotes.ImageFileCache) {
+func v1Handler(w http.ResponseWriter, r *http.Request, store *emotes.EmoteStore, cache emotes.ImageCache) {
 	// URL is in format of "/emoticons/v1/<id>/<size>"
 	parts := strings.Split(r.URL.Path, "/")
 
@@ -56,7 +66,7 @@ func v1Handler(w http.ResponseWriter, r *http.Request, store *emotes.EmoteStore,
 	commonHandler(w, r, store, cache, id, size, false)
 }
 
-func v2Handler(w http.ResponseWriter, r *http.Request, store *emotes.EmoteStore, cache *emotes.ImageFileCache) {
+func v2Handler(w http.ResponseWriter, r *http.Request, store *emotes.EmoteStore, cache emotes.ImageCache) {
 	// URL is in format of "/emoticons/v2/<id>/<format>/<theme_mode>/<size>"
 	parts := strings.Split(r.URL.Path, "/")
 
@@ -76,7 +86,7 @@ func v2Handler(w http.ResponseWriter, r *http.Request, store *emotes.EmoteStore,
 	commonHandler(w, r, store, cache, id, size, true)
 }
 
-func commonHandler(w http.ResponseWriter, r *http.Request, store *emotes.EmoteStore, cache *emotes.ImageFileCache, id string, size emotes.ImageSize, gifSupport bool) {
+func commonHandler(w http.ResponseWriter, r *http.Request, store *emotes.EmoteStore, cache emotes.ImageCache, id string, size emotes.ImageSize, gifSupport bool) {
 	if len(id) < 2 {
 		log.Printf("Got unknown emote code %q\n", r.URL)
 		http.NotFound(w, r)
@@ -93,55 +103,149 @@ func commonHandler(w http.ResponseWriter, r *http.Request, store *emotes.EmoteSt
 	id = id[1:]
 
 	isVirtual := code == 'v'
-	var half emotes.VirtualHalf = -1
+	var tile emotes.Tile
 	if isVirtual {
-		// At this point, 'id' is in the form of [l/r][emote_type][emote_id]
-		if len(id) < 3 {
+		// At this point, 'id' is in the form of [l/r/<index>of<count>][emote_type][emote_id]
+		var ok bool
+		tile, id, ok = emotes.ParseTile(id)
+		if !ok || len(id) < 2 {
+			log.Printf("Requested virtual emote with unknown tile %q\n", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		code = id[0]
+		id = id[1:]
+	}
+
+	isOverlay := code == 'o'
+	var overlays []emotes.Emote
+	if isOverlay {
+		// At this point, 'id' is in the form of [emote_type][emote_id].[emote_type][emote_id]...
+		parts := strings.Split(id, emotes.OverlaySeparator)
+		if len(parts) < 2 || len(parts) > emotes.MaxOverlayCount+1 {
+			log.Printf("Requested overlay emote with %d parts %q\n", len(parts), r.URL)
+			http.NotFound(w, r)
+			return
+		}
+
+		for _, part := range parts[1:] {
+			if len(part) < 2 {
+				log.Printf("Got unknown emote code %q\n", r.URL)
+				http.NotFound(w, r)
+				return
+			}
+			overlay, found := store.GetEmote(r.Context(), rune(part[0]), part[1:])
+			if !found {
+				log.Printf("Requested overlay emote with code %q id %q but wasn't found\n", rune(part[0]), part[1:])
+				http.NotFound(w, r)
+				return
+			}
+			overlays = append(overlays, overlay)
+		}
+
+		if len(parts[0]) < 2 {
 			log.Printf("Got unknown emote code %q\n", r.URL)
 			http.NotFound(w, r)
 			return
 		}
+		code = parts[0][0]
+		id = parts[0][1:]
+	}
 
-		switch id[0] {
-		case 'l':
-			half = emotes.LeftHalf
-		case 'r':
-			half = emotes.RightHalf
-		default:
-			log.Printf("Requested Virtual emote with unknown side %q\n", id[0])
+	isModified := code == 'm'
+	var modifiers emotes.Modifiers
+	if isModified {
+		// At this point, 'id' is in the form of [modifiers].[emote_type][emote_id]
+		parts := strings.SplitN(id, emotes.ModifierSeparator, 2)
+		var ok bool
+		if len(parts) == 2 {
+			modifiers, ok = emotes.ParseModifiers(parts[0])
+		}
+		if !ok || len(parts[1]) < 2 {
+			log.Printf("Requested modified emote with unknown modifiers %q\n", r.URL)
 			http.NotFound(w, r)
 			return
 		}
-		code = id[1]
-		id = id[2:]
+		code = parts[1][0]
+		id = parts[1][1:]
 	}
 
-	emote, found := store.GetEmote(rune(code), id)
+	emote, found := store.GetEmote(r.Context(), rune(code), id)
 	if !found {
 		log.Printf("Requested emote with code %q id %q but wasn't found\n", rune(code), id)
 		http.NotFound(w, r)
 		return
 	}
 
-	if cache == nil || (gifSupport && !isPNG(emote)) || emotes.ShouldNotCache(emote) { // fallback to emote cdn
+	canComposite := true
+	for _, overlay := range overlays {
+		if emotes.ShouldNotCache(overlay) {
+			canComposite = false
+		}
+	}
+
+	if cache == nil || emotes.ShouldNotCache(emote) || !canComposite { // fallback to emote cdn
+		// Overlays can't be drawn without processing, so only the base emote is shown
+		w.Header().Set("Cache-Control", cacheControl(redirectMaxAge))
 		http.Redirect(w, r, emote.URL(size), http.StatusFound)
 	} else { // use our own cache
-		w.Header().Set("Content-Type", "image/png")
-
+		var img *emotes.Image
 		var err error
+		// Only v2 clients can display animated emotes
 		if isVirtual {
-			err = cache.GetCachedOrDownloadHalf(emote, size, half, w)
+			img, err = cache.GetCachedOrDownloadTile(r.Context(), emote, size, tile, gifSupport)
+		} else if isModified {
+			img, err = cache.GetCachedOrDownloadModified(r.Context(), emote, size, modifiers, gifSupport)
+		} else if isOverlay {
+			img, err = cache.GetCachedOrDownloadOverlay(r.Context(), emote, overlays, size, gifSupport)
 		} else {
-			err = cache.GetCachedOrDownload(emote, size, w)
+			img, err = cache.GetCachedOrDownload(r.Context(), emote, size, gifSupport)
 		}
 
 		if err != nil {
 			log.Printf("Error downloading emote: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
+			status := errorStatus(err)
+			if !isVirtual && (status == http.StatusUnsupportedMediaType || status == http.StatusInternalServerError) {
+				// We failed to process the emote, let the client try the original
+				http.Redirect(w, r, emote.URL(size), http.StatusFound)
+				return
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
 		}
+
+		animated := emotes.IsAnimatedType(emote.Type())
+		for _, overlay := range overlays {
+			animated = animated || emotes.IsAnimatedType(overlay.Type())
+		}
+		serveImage(w, r, img)
 	}
 }
 
-func isPNG(emote emotes.Emote) bool {
-	return emote.Type() == "png" || emote.Type() == "image/png"
+// errorStatus maps an error from the emotes package to a response status.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, emotes.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, emotes.ErrUpstreamUnavailable):
+		return http.StatusBadGateway
+	case errors.Is(err, emotes.ErrUnsupportedFormat):
+		return http.StatusUnsupportedMediaType
+	default: // includes emotes.ErrDecode
+		return http.StatusInternalServerError
+	}
+}
+
+// serveImage writes a processed image, answering conditional and HEAD
+// requests without sending the body.
+func serveImage(w http.ResponseWriter, r *http.Request, img *emotes.Image) {
+	h := w.Header()
+	h.Set("Content-Type", img.ContentType)
+	h.Set("ETag", img.ETag)
+	h.Set("Cache-Control", cacheControl(emoteMaxAge))
+	http.ServeContent(w, r, "", img.ModTime, bytes.NewReader(img.Data))
+}
+
+func cacheControl(maxAge time.Duration) string {
+	return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
 }
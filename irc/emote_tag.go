@@ -93,3 +93,19 @@ func (e *EmoteTag) Add(emoteID string, index IndexPair) {
 		e.Emotes[emoteID] = []IndexPair{index}
 	}
 }
+
+func (e *EmoteTag) Remove(emoteID string, index IndexPair) {
+	val := e.Emotes[emoteID]
+	for i, v := range val {
+		if v == index {
+			val = append(val[:i], val[i+1:]...)
+			break
+		}
+	}
+
+	if len(val) == 0 {
+		delete(e.Emotes, emoteID)
+	} else {
+		e.Emotes[emoteID] = val
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/go-redis/redis/v8"
 	"log"
 	"net/http"
-	"time"
 )
 
 func MakeServer(cfg *app.ServerConfig) *http.Server {
@@ -27,34 +26,61 @@ func MakeServer(cfg *app.ServerConfig) *http.Server {
 }
 
 func handleRequest(cfg *app.ServerConfig) http.HandlerFunc {
-	store := emotes.NewEmoteStore()
-	if err := store.Init(); err != nil {
-		log.Fatalln(err)
+	var redisOptions *redis.Options = nil
+	if cfg.RedisConn != "" {
+		opts, err := redis.ParseURL(cfg.RedisConn)
+		if err != nil {
+			log.Fatalf("Parse redis URL: %v\n", err)
+		}
+		redisOptions = opts
 	}
 
-	var cache *emotes.ImageFileCache = nil
-	if cfg.CachePath != "" { // cache is enabled
-		cache = emotes.NewImageFileCache(cfg.CachePath, time.Hour*48, true)
-		if err := cache.Index(); err != nil {
-			log.Fatalln(err)
+	fetcher := emotes.NewHTTPFetcher(nil, cfg.Fetcher)
+	store := emotes.NewEmoteStore(cfg.Providers, fetcher, cfg.Context)
+
+	cache := makeImageCache(cfg, redisOptions, fetcher)
+
+	if cfg.SharedCache {
+		if redisOptions == nil {
+			log.Fatalln("The shared cache requires a Redis connection string")
+		}
+		shared := storage.NewRedisSharedCache(cfg.RedisNamespace, redisOptions, cfg.Context)
+		if err := shared.Ping(); err != nil {
+			log.Fatalf("Failed to communicate with Redis: %v\n", err)
+		}
+		store.SetSharedCache(shared)
+		if cache != nil {
+			cache.SetSharedCache(shared)
 		}
+	}
 
-		if cfg.Purge {
-			if err := cache.Purge(); err != nil {
-				log.Fatalf("Purge cache: %v\n", err)
-			}
+	snapshotter := makeSnapshotter(cfg, redisOptions, store, cache)
+	restored := false
+	if snapshotter != nil {
+		var err error
+		if restored, err = snapshotter.Restore(); err != nil {
+			log.Printf("Warning: %v\n", err)
 		}
+	}
 
-		go cache.AutoEvict(cfg.Context)
+	if restored { // serve the snapshot immediately and revalidate in the background
+		go func() {
+			if err := store.Init(cfg.Context); err != nil {
+				log.Printf("Warning: %v\n", err)
+			}
+		}()
+	} else if err := store.Init(cfg.Context); err != nil {
+		// Failed providers are retried in the background
+		log.Printf("Warning: %v\n", err)
+	}
+
+	if snapshotter != nil {
+		go snapshotter.Run(cfg.Context)
 	}
 
 	var settingsRepository storage.SettingsRepository = nil
-	if cfg.RedisConn != "" {
-		opts, err := redis.ParseURL(cfg.RedisConn)
-		if err != nil {
-			log.Fatalf("Parse redis URL: %v\n", err)
-		}
-		r := storage.NewRedisSettingsRepository(cfg.RedisNamespace, opts, cfg.Context)
+	if redisOptions != nil {
+		r := storage.NewRedisSettingsRepository(cfg.RedisNamespace, redisOptions, cfg.Context)
 		if err := r.Ping(); err != nil {
 			log.Fatalf("Failed to communicate with Redis: %v\n", err)
 		}
@@ -62,22 +88,118 @@ func handleRequest(cfg *app.ServerConfig) http.HandlerFunc {
 		log.Println("Connected to Redis")
 	}
 
+	var imageCache emotes.ImageCache = nil
+	if cache != nil {
+		imageCache = cache
+	}
+
 	appCtx := &app.Context{
 		EmoteStore:         store,
-		ImageCache:         cache,
+		ImageCache:         imageCache,
 		Config:             cfg,
 		SettingsRepository: settingsRepository,
+		LiveUpdates:        makeLiveUpdates(cfg, store, fetcher),
 	}
 
 	manager := NewWsForwarder(appCtx)
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Host == cfg.WebsocketHost {
+		if r.URL.Path == healthPath {
+			handleHealthRequest(w, r, store)
+		} else if r.Host == cfg.WebsocketHost {
 			manager.HandleWsConnection(w, r)
 		} else if r.Host == cfg.EmoticonHost {
-			handleEmoticonRequest(w, r, store, cache)
+			handleEmoticonRequest(w, r, store, imageCache)
 		} else {
 			log.Printf("Got unexpected Host value %q\n", r.Host)
 			http.NotFound(w, r)
 		}
 	}
 }
+
+// makeLiveUpdates creates and runs the live emote updates selected by the
+// config, or returns nil if they are disabled.
+func makeLiveUpdates(cfg *app.ServerConfig, store *emotes.EmoteStore, fetcher emotes.Fetcher) *emotes.LiveUpdates {
+	if !cfg.LiveUpdates {
+		return nil
+	}
+
+	providers := cfg.Providers
+	if providers == nil {
+		providers = emotes.DefaultProviderConfig()
+	}
+
+	var sources []emotes.LiveSource
+	if providers.Bttv.Events != "" {
+		sources = append(sources, emotes.NewBttvLiveSource(providers.Bttv))
+	}
+	if providers.SevenTV.Events != "" {
+		sources = append(sources, emotes.NewSevenTVLiveSource(providers.SevenTV, fetcher))
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	live := emotes.NewLiveUpdates(store, sources, cfg.Context)
+	go live.Run()
+	return live
+}
+
+// makeImageCache creates the image cache selected by the config, or nil if caching is disabled.
+func makeImageCache(cfg *app.ServerConfig, redisOptions *redis.Options, fetcher emotes.Fetcher) *emotes.BlobImageCache {
+	var blobs emotes.BlobStore
+	switch cfg.CacheBackend {
+	case "", "file":
+		if cfg.CachePath == "" { // cache is disabled
+			return nil
+		}
+
+		files := emotes.NewImageFileCache(cfg.CachePath, cfg.CacheTTL, cfg.CacheMaxBytes, true)
+		if err := files.Index(); err != nil {
+			log.Fatalln(err)
+		}
+		go files.AutoEvict(cfg.Context, cfg.CacheEvictInterval)
+		blobs = files
+	case "memory":
+		blobs = emotes.NewMemoryBlobStore(cfg.CacheMemoryBytes)
+	case "redis":
+		if redisOptions == nil {
+			log.Fatalln("The redis cache backend requires a Redis connection string")
+		}
+		r := storage.NewRedisBlobStore(cfg.RedisNamespace, redisOptions, cfg.CacheTTL, cfg.Context)
+		if err := r.Ping(); err != nil {
+			log.Fatalf("Failed to communicate with Redis: %v\n", err)
+		}
+		blobs = r
+	default:
+		log.Fatalf("Unknown cache backend %q\n", cfg.CacheBackend)
+	}
+
+	if cfg.Purge {
+		if err := blobs.Purge(); err != nil {
+			log.Fatalf("Purge cache: %v\n", err)
+		}
+	}
+
+	return emotes.NewBlobImageCache(blobs, fetcher)
+}
+
+func makeSnapshotter(cfg *app.ServerConfig, redisOptions *redis.Options, store *emotes.EmoteStore, cache *emotes.BlobImageCache) *emotes.Snapshotter {
+	var backend emotes.SnapshotBackend
+	if cfg.SnapshotRedis {
+		if redisOptions == nil {
+			log.Fatalln("Redis snapshots require a Redis connection string")
+		}
+		backend = storage.NewRedisSnapshotRepository(cfg.RedisNamespace, redisOptions, cfg.Context)
+	} else if cfg.SnapshotPath != "" {
+		backend = emotes.NewFileSnapshotBackend(cfg.SnapshotPath)
+	} else {
+		return nil
+	}
+
+	var ratios emotes.AspectRatioStore = nil
+	if cache != nil {
+		ratios = cache
+	}
+
+	return emotes.NewSnapshotter(store, ratios, backend, cfg.SnapshotInterval)
+}
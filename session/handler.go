@@ -31,10 +31,14 @@ func (s *wsSession) handleTwitchMessage(msg *irc.Message) (bool, error) {
 
 		channelName := strings.ToLower(msg.Params[0])
 		channelNameMap[channelName] = channelID
+		s.watch(channelName, channelID)
 
-		if err := s.emoteStore.LoadIfNotLoaded(channelID); err != nil {
-			return false, fmt.Errorf("load channel: %w", err)
-		}
+		// Load in the background so the Twitch reader isn't stalled by provider requests
+		go func() {
+			if err := s.emoteStore.LoadIfNotLoaded(s.ctx, channelID); err != nil {
+				log.Printf("Error loading channel %q: %v\n", channelID, err)
+			}
+		}()
 	}
 
 	return false, nil
@@ -45,7 +49,7 @@ func (s *wsSession) handleClientMessage(msg *irc.Message) (bool, bool, error) {
 	switch msg.Command {
 	case "PASS":
 		go func() {
-			userID, err := GetUserIDFromOAuth(msg.Params[0])
+			userID, err := GetUserIDFromOAuth(s.ctx, msg.Params[0])
 			if err != nil {
 				log.Printf("Error getting User ID: %v\n", err)
 				return
@@ -72,6 +76,13 @@ func (s *wsSession) handleClientMessage(msg *irc.Message) (bool, bool, error) {
 				s.settings = settings
 			}
 		}()
+	case "PART":
+		if len(msg.Params) == 0 {
+			break
+		}
+		for _, channelName := range strings.Split(msg.Params[0], ",") {
+			s.unwatch(strings.ToLower(channelName))
+		}
 	case "NICK":
 		if !s.state.Greeted {
 			s.state.Username = msg.Params[0]
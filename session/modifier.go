@@ -4,14 +4,16 @@ import (
 	"github.com/dnsge/twitch-mobile-emotes/emotes"
 	"github.com/dnsge/twitch-mobile-emotes/irc"
 	"log"
+	"math"
 	"math/rand"
 	"strings"
 	"time"
 	"unicode/utf8"
 )
 
-const leftPrefix = "vl"
-const rightPrefix = "vr"
+const virtualPrefix = "v"
+const overlayPrefix = "o"
+const modifierPrefix = "m"
 
 const commandRune = 0x01
 const CacheDestroyerSize = 3
@@ -39,24 +41,26 @@ func injectThirdPartyEmotes(s *wsSession, msg *irc.Message, channelID string) er
 		}
 	}
 
+	// The previous word's emote, if it can be modified or drawn over
+	var last *taggedEmote
+	// Modifier words typed right before the current word
+	var pending *pendingModifiers
+	var tagged []*taggedEmote
+
 	i := 0
 	for _, word := range strings.Split(messageBody, " ") {
 		wordLen := utf8.RuneCountInString(word) // UTF-8 so emojis don't mess up
-		if e, found := s.emoteStore.GetEmoteFromWord(word, channelID); found {
-			if s.showGifs() || e.Type() != "gif" {
-				wide := false // wide will always be false if imageCache is disabled
-				if s.imageCache != nil {
-					ratio, err := s.imageCache.GetEmoteAspectRatio(e)
-					if err != nil {
-						return err
-					}
-					wide = isWide(ratio)
-				}
-
-				if s.config.Debug {
-					log.Printf("found emote %q %s (wide: %t) %q\n", word, e.Type(), wide, e.LetterCode()+e.EmoteID())
-				}
+		var next *taggedEmote
+		var nextPending *pendingModifiers
 
+		if m, ok := emotes.ParseModifierWord(word); ok && s.imageCache != nil {
+			nextPending = pending
+			if nextPending == nil {
+				nextPending = &pendingModifiers{start: i}
+			}
+			nextPending.modifiers = nextPending.modifiers.Combine(m)
+		} else if e, found := s.emoteStore.GetEmoteFromWord(word, channelID); found {
+			if s.showGifs() || e.Type() != emotes.MimeTypeGIF {
 				cacheDestroyerPrefix := ""
 				if s.settings != nil && s.settings.CacheDestroyerKey != "" {
 					if len(s.settings.CacheDestroyerKey) != CacheDestroyerSize {
@@ -65,39 +69,180 @@ func injectThirdPartyEmotes(s *wsSession, msg *irc.Message, channelID string) er
 					cacheDestroyerPrefix = "d" + s.settings.CacheDestroyerKey
 				}
 
-				if wide && wordLen >= 3 && !emotes.ShouldNotCache(e) {
-					emoteTag.Add(cacheDestroyerPrefix+leftPrefix+e.LetterCode()+e.EmoteID(), [2]int{i, i + 1})
-					emoteTag.Add(cacheDestroyerPrefix+rightPrefix+e.LetterCode()+e.EmoteID(), [2]int{i + 2, i + wordLen - 1})
-					go func() {
-						err := s.imageCache.DownloadVirtualToCache(e, emotes.ImageSizeLarge)
-						if err != nil {
-							log.Printf("Pre-fetch virtual emote: %v\n", err)
-						}
-					}()
+				if m, ok := emotes.EmoteModifiers(e); ok && last != nil && len(last.overlays) == 0 {
+					// Modify the previous emote, which now covers both words
+					if s.config.Debug {
+						log.Printf("found modifier emote %q (%s) for %q\n", word, m, last.emote.LetterCode()+last.emote.EmoteID())
+					}
+
+					last.modifiers = last.modifiers.Combine(m)
+					last.retag(emoteTag, cacheDestroyerPrefix, i+wordLen-1)
+					next = last
+				} else if last != nil && last.modifiers == 0 && emotes.IsZeroWidth(e) && len(last.overlays) < emotes.MaxOverlayCount && !emotes.ShouldNotCache(e) {
+					// Draw the zero-width emote over the previous one, which
+					// now covers both words
+					if s.config.Debug {
+						log.Printf("found zero-width emote %q %s over %q\n", word, e.Type(), last.emote.LetterCode()+last.emote.EmoteID())
+					}
+
+					last.overlays = append(last.overlays, e)
+					last.retag(emoteTag, cacheDestroyerPrefix, i+wordLen-1)
+					next = last
+				} else if pending != nil && !emotes.ShouldNotCache(e) {
+					// The emote also covers the modifier words before it
+					if s.config.Debug {
+						log.Printf("found modified emote %q %s (%s) %q\n", word, e.Type(), pending.modifiers, e.LetterCode()+e.EmoteID())
+					}
+
+					next = &taggedEmote{emote: e, modifiers: pending.modifiers, index: irc.IndexPair{pending.start, pending.start}}
+					next.retag(emoteTag, cacheDestroyerPrefix, i+wordLen-1)
+					tagged = append(tagged, next)
 				} else {
-					emoteTag.Add(cacheDestroyerPrefix+e.LetterCode()+e.EmoteID(), [2]int{i, i + wordLen - 1})
+					tiles := 1 // tiles will always be 1 if imageCache is disabled
 					if s.imageCache != nil && !emotes.ShouldNotCache(e) {
+						ratio, err := s.imageCache.GetEmoteAspectRatio(s.ctx, e)
+						if err != nil {
+							return err
+						}
+						tiles = tileCount(ratio, wordLen, s.config.MaxEmoteTiles)
+					}
+
+					if s.config.Debug {
+						log.Printf("found emote %q %s (tiles: %d) %q\n", word, e.Type(), tiles, e.LetterCode()+e.EmoteID())
+					}
+
+					if tiles > 1 {
+						start := i
+						for t, length := range splitWord(wordLen, tiles) {
+							tile := emotes.Tile{Index: t, Count: tiles}
+							emoteTag.Add(cacheDestroyerPrefix+virtualPrefix+tile.LetterCode()+e.LetterCode()+e.EmoteID(), [2]int{start, start + length - 1})
+							start += length
+						}
 						go func() {
-							err := s.imageCache.DownloadToCache(e, emotes.ImageSizeLarge)
+							err := s.imageCache.DownloadVirtualToCache(s.ctx, e, emotes.ImageSizeLarge, tiles, s.showGifs())
 							if err != nil {
-								log.Printf("Pre-fetch emote: %v\n", err)
+								log.Printf("Pre-fetch virtual emote: %v\n", err)
 							}
 						}()
+					} else {
+						tagID := cacheDestroyerPrefix + e.LetterCode() + e.EmoteID()
+						index := irc.IndexPair{i, i + wordLen - 1}
+						emoteTag.Add(tagID, index)
+						if s.imageCache != nil && !emotes.ShouldNotCache(e) {
+							next = &taggedEmote{emote: e, tagID: tagID, index: index}
+							tagged = append(tagged, next)
+						}
 					}
 				}
 			}
 		}
+		last = next
+		pending = nextPending
 		i += wordLen + 1
 	}
 
+	// Pre-fetch once everything that follows an emote has been folded into it
+	for _, t := range tagged {
+		go t.prefetch(s)
+	}
+
 	msg.Tags["emotes"] = emoteTag.TagValue()
 	return nil
 }
 
+// taggedEmote is an emote tagged on its own, which zero-width and modifier
+// emotes that follow it can be folded into.
+type taggedEmote struct {
+	emote     emotes.Emote
+	overlays  []emotes.Emote
+	modifiers emotes.Modifiers
+	// Emote tag entry of the emote, including what was folded into it
+	tagID string
+	index irc.IndexPair
+}
+
+// pendingModifiers are modifier words waiting for the emote they modify.
+type pendingModifiers struct {
+	modifiers emotes.Modifiers
+	// Index of the first modifier word
+	start int
+}
+
+func (t *taggedEmote) id() string {
+	switch {
+	case len(t.overlays) > 0:
+		return overlayPrefix + emotes.OverlayID(t.emote, t.overlays)
+	case t.modifiers != 0:
+		return modifierPrefix + emotes.ModifiedID(t.emote, t.modifiers)
+	default:
+		return t.emote.LetterCode() + t.emote.EmoteID()
+	}
+}
+
+// retag replaces the emote tag entry of the emote with one that ends at end.
+func (t *taggedEmote) retag(tag *irc.EmoteTag, cacheDestroyerPrefix string, end int) {
+	tag.Remove(t.tagID, t.index)
+	t.tagID = cacheDestroyerPrefix + t.id()
+	t.index = irc.IndexPair{t.index[0], end}
+	tag.Add(t.tagID, t.index)
+}
+
+func (t *taggedEmote) prefetch(s *wsSession) {
+	var err error
+	switch {
+	case len(t.overlays) > 0:
+		err = s.imageCache.DownloadOverlayToCache(s.ctx, t.emote, t.overlays, emotes.ImageSizeLarge, s.showGifs())
+	case t.modifiers != 0:
+		err = s.imageCache.DownloadModifiedToCache(s.ctx, t.emote, emotes.ImageSizeLarge, t.modifiers, s.showGifs())
+	default:
+		err = s.imageCache.DownloadToCache(s.ctx, t.emote, emotes.ImageSizeLarge, s.showGifs())
+	}
+	if err != nil {
+		log.Printf("Pre-fetch emote %q: %v\n", t.id(), err)
+	}
+}
+
 func isWide(ratio float64) bool {
 	return ratio >= 1.75
 }
 
+// tileCount returns the number of tiles a wide emote is split into, one for
+// emotes that aren't split. Each tile is roughly square, and every tile must
+// cover at least one character of the typed word.
+func tileCount(ratio float64, wordLen int, maxTiles int) int {
+	if !isWide(ratio) || wordLen < 3 || maxTiles < 2 {
+		return 1
+	}
+
+	n := int(math.Round(ratio))
+	if n < 2 {
+		n = 2
+	}
+	if n > maxTiles {
+		n = maxTiles
+	}
+	if n > emotes.MaxTileCount {
+		n = emotes.MaxTileCount
+	}
+	if n > wordLen {
+		n = wordLen
+	}
+	return n
+}
+
+// splitWord distributes wordLen characters across n tiles, giving the extra
+// characters to the leftmost tiles.
+func splitWord(wordLen int, n int) []int {
+	lengths := make([]int, n)
+	for i := range lengths {
+		lengths[i] = wordLen / n
+		if i < wordLen%n {
+			lengths[i]++
+		}
+	}
+	return lengths
+}
+
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
 
 func newCacheDestroyer(size int) string {
@@ -0,0 +1,279 @@
+package session
+
+import (
+	"context"
+	"github.com/dnsge/twitch-mobile-emotes/app"
+	"github.com/dnsge/twitch-mobile-emotes/emotes"
+	"github.com/dnsge/twitch-mobile-emotes/irc"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testChannelID = "1"
+
+// testProviderResponses are the API responses of the fake providers, by path.
+var testProviderResponses = map[string]string{
+	"/bttv/cached/emotes/global":                 `[{"id":"cvm","code":"cvMask","imageType":"png"}]`,
+	"/bttv/cached/users/twitch/" + testChannelID: `{"channelEmotes":[{"id":"sq","code":"Square","imageType":"png"},{"id":"w2","code":"Wide2","imageType":"png"},{"id":"w3","code":"Wide3","imageType":"png"},{"id":"w9","code":"Wide9","imageType":"png"},{"id":"ws","code":"W3","imageType":"png"}],"sharedEmotes":[]}`,
+	"/ffz/set/global":                            `{"default_sets":[3],"sets":{"3":{"emoticons":[{"id":10,"name":"ffzX","modifier":true,"modifier_flags":2}]}}}`,
+	"/ffz/room/id/" + testChannelID:              `{"room":{"set":7},"sets":{"7":{"emoticons":[]}}}`,
+	"/7tv/emote-sets/global":                     `{"id":"global","emotes":[]}`,
+	"/7tv/users/twitch/" + testChannelID:         `{"emote_set":{"id":"set","emotes":[]}}`,
+}
+
+// testAspectRatios are the aspect ratios of the fake emotes that aren't square.
+var testAspectRatios = map[string]float64{
+	"bw2": 2,
+	"bw3": 3,
+	"bw9": 9,
+	"bws": 3,
+}
+
+// fakeImageCache reports the aspect ratios of testAspectRatios and doesn't
+// download anything.
+type fakeImageCache struct{}
+
+var _ emotes.ImageCache = fakeImageCache{}
+
+func (fakeImageCache) GetCachedOrDownload(context.Context, emotes.Emote, emotes.ImageSize, bool) (*emotes.Image, error) {
+	return nil, nil
+}
+
+func (fakeImageCache) GetCachedOrDownloadTile(context.Context, emotes.Emote, emotes.ImageSize, emotes.Tile, bool) (*emotes.Image, error) {
+	return nil, nil
+}
+
+func (fakeImageCache) GetCachedOrDownloadOverlay(context.Context, emotes.Emote, []emotes.Emote, emotes.ImageSize, bool) (*emotes.Image, error) {
+	return nil, nil
+}
+
+func (fakeImageCache) GetCachedOrDownloadModified(context.Context, emotes.Emote, emotes.ImageSize, emotes.Modifiers, bool) (*emotes.Image, error) {
+	return nil, nil
+}
+
+func (fakeImageCache) DownloadToCache(context.Context, emotes.Emote, emotes.ImageSize, bool) error {
+	return nil
+}
+
+func (fakeImageCache) DownloadModifiedToCache(context.Context, emotes.Emote, emotes.ImageSize, emotes.Modifiers, bool) error {
+	return nil
+}
+
+func (fakeImageCache) DownloadOverlayToCache(context.Context, emotes.Emote, []emotes.Emote, emotes.ImageSize, bool) error {
+	return nil
+}
+
+func (fakeImageCache) DownloadVirtualToCache(context.Context, emotes.Emote, emotes.ImageSize, int, bool) error {
+	return nil
+}
+
+func (fakeImageCache) GetEmoteAspectRatio(_ context.Context, emote emotes.Emote) (float64, error) {
+	if ratio, ok := testAspectRatios[emote.LetterCode()+emote.EmoteID()]; ok {
+		return ratio, nil
+	}
+	return 1, nil
+}
+
+func (fakeImageCache) Purge() error {
+	return nil
+}
+
+// newTestSession returns a session whose emote store is loaded from fake
+// providers serving testProviderResponses.
+func newTestSession(t *testing.T, maxTiles int) *wsSession {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := testProviderResponses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	config := &emotes.ProviderConfig{
+		Bttv:    emotes.ProviderEndpoints{APIBase: server.URL + "/bttv"},
+		Ffz:     emotes.ProviderEndpoints{APIBase: server.URL + "/ffz"},
+		SevenTV: emotes.ProviderEndpoints{APIBase: server.URL + "/7tv"},
+	}
+	opts := emotes.DefaultFetcherOptions()
+	opts.MaxRetries = 0
+	store := emotes.NewEmoteStore(config, emotes.NewHTTPFetcher(nil, opts), ctx)
+	if err := store.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if err := store.LoadIfNotLoaded(ctx, testChannelID); err != nil {
+		t.Fatalf("LoadIfNotLoaded: %v", err)
+	}
+
+	return &wsSession{
+		ctx:                ctx,
+		config:             &app.ServerConfig{MaxEmoteTiles: maxTiles},
+		emoteStore:         store,
+		imageCache:         fakeImageCache{},
+		defaultIncludeGifs: true,
+	}
+}
+
+// injectedEmotes returns the emotes tag of a message after injecting third
+// party emotes into it.
+func injectedEmotes(t *testing.T, s *wsSession, emotesTag, text string) irc.EmoteMap {
+	t.Helper()
+	msg, err := irc.ParseMessage("@emotes=" + emotesTag + " :user!user@user.tmi.twitch.tv PRIVMSG #channel :" + text)
+	if err != nil {
+		t.Fatalf("ParseMessage: %v", err)
+	}
+	if err := injectThirdPartyEmotes(s, msg, testChannelID); err != nil {
+		t.Fatalf("injectThirdPartyEmotes: %v", err)
+	}
+	return parseEmotes(t, string(msg.Tags["emotes"]))
+}
+
+func parseEmotes(t *testing.T, value string) irc.EmoteMap {
+	t.Helper()
+	tag, err := irc.NewEmoteTag(irc.TagValue(value))
+	if err != nil {
+		t.Fatalf("NewEmoteTag(%q): %v", value, err)
+	}
+	return tag.Emotes
+}
+
+func TestTileCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		ratio    float64
+		wordLen  int
+		maxTiles int
+		want     int
+	}{
+		{"Square", 1, 5, 4, 1},
+		{"NotWideEnough", 1.74, 5, 4, 1},
+		{"BarelyWide", 1.75, 5, 4, 2},
+		{"RoundsDown", 3.4, 10, 4, 3},
+		{"RoundsUp", 3.6, 10, 4, 4},
+		{"CappedByMaxTiles", 6, 10, 4, 4},
+		{"RaisedMaxTiles", 6, 10, 8, 6},
+		{"CappedByMaxTileCount", 12, 20, 16, emotes.MaxTileCount},
+		{"CappedByWordLength", 5, 3, 8, 3},
+		{"ShortWord", 3, 2, 4, 1},
+		{"SplittingDisabled", 3, 10, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tileCount(tt.ratio, tt.wordLen, tt.maxTiles); got != tt.want {
+				t.Errorf("tileCount(%v, %d, %d) = %d, want %d", tt.ratio, tt.wordLen, tt.maxTiles, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitWord(t *testing.T) {
+	tests := []struct {
+		wordLen int
+		n       int
+		want    []int
+	}{
+		{3, 3, []int{1, 1, 1}},
+		{5, 3, []int{2, 2, 1}},
+		{6, 3, []int{2, 2, 2}},
+		{7, 2, []int{4, 3}},
+		{5, 4, []int{2, 1, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		if got := splitWord(tt.wordLen, tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitWord(%d, %d) = %v, want %v", tt.wordLen, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestInjectThirdPartyEmotesTiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxTiles  int
+		emotesTag string
+		text      string
+		want      string
+	}{
+		{"Square", 4, "", "Square", "bsq:0-5"},
+		{"Halves", 4, "", "Wide2", "vlbw2:0-2/vrbw2:3-4"},
+		{"Thirds", 4, "", "hi Wide3 Square", "v0of3bw3:3-4/v1of3bw3:5-6/v2of3bw3:7-7/bsq:9-14"},
+		{"CappedByMaxTiles", 4, "", "Wide9", "v0of4bw9:0-1/v1of4bw9:2-2/v2of4bw9:3-3/v3of4bw9:4-4"},
+		{"CappedByWordLength", 8, "", "Wide9", "v0of5bw9:0-0/v1of5bw9:1-1/v2of5bw9:2-2/v3of5bw9:3-3/v4of5bw9:4-4"},
+		{"ShortWord", 4, "", "W3", "bws:0-1"},
+		{"SplittingDisabled", 1, "", "Wide9", "bw9:0-4"},
+		{"KeepsTwitchEmotes", 4, "25:0-4", "Kappa Wide2 Wide2", "25:0-4/vlbw2:6-8,12-14/vrbw2:9-10,15-16"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession(t, tt.maxTiles)
+			got := injectedEmotes(t, s, tt.emotesTag, tt.text)
+			if want := parseEmotes(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("emotes = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestInjectThirdPartyEmotesModifiers(t *testing.T) {
+	tests := []struct {
+		name      string
+		emotesTag string
+		text      string
+		want      string
+	}{
+		{"ModifierWord", "", "h! Square", "mh.bsq:0-8"},
+		{"ModifierWords", "", "w! h! Square", "mhw.bsq:0-11"},
+		{"ModifierWordMidMessage", "", "hi h! Square", "mh.bsq:3-11"},
+		{"FfzModifier", "", "Square ffzX", "mh.bsq:0-10"},
+		{"ModifierWordAndFfzModifier", "", "h! Square ffzX", "mh.bsq:0-13"},
+		{"ZeroWidth", "", "Square cvMask", "obsq.bcvm:0-12"},
+		{"ZeroWidthAfterModifier", "", "h! Square cvMask", "mh.bsq:0-8/bcvm:10-15"},
+		{"HiddenWord", "", "z! Square", "bsq:0-8"},
+		{"TrailingModifierWord", "", "Square h!", "bsq:0-5"},
+		{"OnlyModifierWord", "", "h!", ""},
+		{"LeadingFfzModifier", "", "ffzX Square", "f10:0-3/bsq:5-10"},
+		{"ModifiedWideEmote", "", "h! Wide2", "mh.bw2:0-7"},
+		{"KeepsTwitchEmotes", "25:0-4", "Kappa h! Square", "25:0-4/mh.bsq:6-14"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession(t, 4)
+			got := injectedEmotes(t, s, tt.emotesTag, tt.text)
+			if want := parseEmotes(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("emotes = %v, want %v", got, want)
+			}
+
+			// Every emote of a virtual ID can be looked up again
+			for id := range got {
+				var parts []string
+				switch {
+				case strings.HasPrefix(id, modifierPrefix):
+					split := strings.SplitN(strings.TrimPrefix(id, modifierPrefix), emotes.ModifierSeparator, 2)
+					if _, ok := emotes.ParseModifiers(split[0]); !ok || len(split) != 2 {
+						t.Errorf("modified emote ID %q doesn't parse", id)
+						continue
+					}
+					parts = split[1:]
+				case strings.HasPrefix(id, overlayPrefix):
+					parts = strings.Split(strings.TrimPrefix(id, overlayPrefix), emotes.OverlaySeparator)
+				}
+				for _, part := range parts {
+					if _, ok := s.emoteStore.GetEmote(s.ctx, rune(part[0]), part[1:]); !ok {
+						t.Errorf("emote %q of virtual emote ID %q not found", part, id)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package session
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// syncConn serializes writes to a WsConn so that messages can be written from
+// several goroutines, such as announcements of emote changes.
+type syncConn struct {
+	WsConn
+	mu sync.Mutex
+}
+
+var _ WsConn = &syncConn{}
+
+func newSyncConn(conn WsConn) *syncConn {
+	return &syncConn{WsConn: conn}
+}
+
+func (c *syncConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.WsConn.WriteMessage(messageType, data)
+}
+
+// NextWriter returns a writer that buffers a message and writes it as a whole
+// once it is closed, so the connection isn't held while the message is built.
+func (c *syncConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &bufferedMessage{
+		conn:        c,
+		messageType: messageType,
+	}, nil
+}
+
+type bufferedMessage struct {
+	bytes.Buffer
+	conn        *syncConn
+	messageType int
+}
+
+func (m *bufferedMessage) Close() error {
+	return m.conn.WriteMessage(m.messageType, m.Bytes())
+}
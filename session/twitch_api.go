@@ -1,6 +1,7 @@
 package session
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"strings"
@@ -17,8 +18,8 @@ type validateResponse struct {
 	UserID string `json:"user_id"`
 }
 
-func GetUserIDFromOAuth(oauth string) (string, error) {
-	req, err := http.NewRequest("GET", twitchValidateEndpoint, nil)
+func GetUserIDFromOAuth(ctx context.Context, oauth string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", twitchValidateEndpoint, nil)
 	if err != nil {
 		return "", err
 	}
@@ -27,7 +27,7 @@ var allCommands = []Command{
 		channelName := strings.ToLower(msg.Params[0])
 		channelID, found := channelNameMap[channelName]
 		if found {
-			err := s.emoteStore.Load(channelID)
+			err := s.emoteStore.Load(s.ctx, channelID)
 			if err != nil {
 				log.Printf("Error reloading channel: %v\n", err)
 				return
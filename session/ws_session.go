@@ -2,6 +2,7 @@ package session
 
 import (
 	"bufio"
+	"context"
 	"github.com/dnsge/twitch-mobile-emotes/app"
 	"github.com/dnsge/twitch-mobile-emotes/emotes"
 	"github.com/dnsge/twitch-mobile-emotes/irc"
@@ -10,6 +11,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 )
 
 const CRLF = "\r\n"
@@ -23,13 +25,19 @@ type WsConn interface {
 }
 
 func RunWsSession(clientConn, twitchConn WsConn, ctx *app.Context) {
+	sessionCtx, cancel := context.WithCancel(ctx.Config.Context)
+	defer cancel()
+
 	session := &wsSession{
+		ctx:                sessionCtx,
 		config:             ctx.Config,
-		clientConn:         clientConn,
-		twitchConn:         twitchConn,
+		clientConn:         newSyncConn(clientConn),
+		twitchConn:         newSyncConn(twitchConn),
 		emoteStore:         ctx.EmoteStore,
 		imageCache:         ctx.ImageCache,
 		settingsRepository: ctx.SettingsRepository,
+		liveUpdates:        ctx.LiveUpdates,
+		watches:            make(map[string]func()),
 
 		defaultIncludeGifs: ctx.Config.IncludeGifs,
 
@@ -40,16 +48,24 @@ func RunWsSession(clientConn, twitchConn WsConn, ctx *app.Context) {
 		},
 		settings: nil,
 	}
+	defer session.unwatchAll()
 	session.run()
 }
 
 type wsSession struct {
+	// ctx is cancelled when the session ends
+	ctx                context.Context
 	config             *app.ServerConfig
 	clientConn         WsConn
 	twitchConn         WsConn
 	emoteStore         *emotes.EmoteStore
-	imageCache         *emotes.ImageFileCache
+	imageCache         emotes.ImageCache
 	settingsRepository storage.SettingsRepository
+	liveUpdates        *emotes.LiveUpdates
+
+	// Stops live emote updates of each joined channel, by channel name
+	watches map[string]func()
+	watchMu sync.Mutex
 
 	defaultIncludeGifs bool
 
@@ -83,6 +99,47 @@ func (s *wsSession) showGifs() bool {
 	}
 }
 
+// watch subscribes to live emote updates of a joined channel, announcing them
+// in chat if enabled.
+func (s *wsSession) watch(channelName, channelID string) {
+	if s.liveUpdates == nil {
+		return
+	}
+
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	if _, ok := s.watches[channelName]; ok {
+		return
+	}
+
+	var announce func(emotes.EmoteChange)
+	if s.config.AnnounceChanges {
+		announce = func(change emotes.EmoteChange) {
+			// Don't hold up updates of other sessions while writing
+			go s.writeClientMessage(1, buildVirtualMessage(systemUser, channelName, change.String()))
+		}
+	}
+	s.watches[channelName] = s.liveUpdates.Watch(channelID, announce)
+}
+
+func (s *wsSession) unwatch(channelName string) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	if stop, ok := s.watches[channelName]; ok {
+		stop()
+		delete(s.watches, channelName)
+	}
+}
+
+func (s *wsSession) unwatchAll() {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	for channelName, stop := range s.watches {
+		stop()
+		delete(s.watches, channelName)
+	}
+}
+
 func (s *wsSession) run() {
 	twitchChan := make(chan error, 1)
 	clientChan := make(chan error, 1)
@@ -96,7 +153,7 @@ func (s *wsSession) run() {
 		errorMessage = "Error proxying from twitch to client: %v\n"
 	case err = <-clientChan:
 		errorMessage = "Error proxying from client to twitch: %v\n"
-	case <-s.config.Context.Done():
+	case <-s.ctx.Done():
 		s.clientConn.Close()
 		s.twitchConn.Close()
 		return
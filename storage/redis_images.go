@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+// RedisBlobStore stores processed emote images in Redis. Images expire after
+// the configured expiration.
+type RedisBlobStore struct {
+	namespace  string
+	client     *redis.Client
+	expiration time.Duration
+	ctx        context.Context
+}
+
+func NewRedisBlobStore(namespace string, options *redis.Options, expiration time.Duration, ctx context.Context) *RedisBlobStore {
+	client := redis.NewClient(options)
+
+	return &RedisBlobStore{
+		namespace:  namespace,
+		client:     client,
+		expiration: expiration,
+		ctx:        ctx,
+	}
+}
+
+func (r *RedisBlobStore) key(name string) string {
+	return r.namespace + ":images:" + name
+}
+
+func (r *RedisBlobStore) Get(key string) ([]byte, error) {
+	data, err := r.client.Get(r.ctx, r.key(key)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (r *RedisBlobStore) Has(key string) (bool, error) {
+	n, err := r.client.Exists(r.ctx, r.key(key)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func (r *RedisBlobStore) Put(key string, data []byte) error {
+	return r.client.Set(r.ctx, r.key(key), data, r.expiration).Err()
+}
+
+func (r *RedisBlobStore) Purge() error {
+	iter := r.client.Scan(r.ctx, 0, r.key("*"), 100).Iterator()
+	for iter.Next(r.ctx) {
+		if err := r.client.Del(r.ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func (r *RedisBlobStore) Ping() error {
+	return r.client.Ping(r.ctx).Err()
+}
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a local stand-in for a Redis server that implements the
+// string commands used by the Redis stores.
+type fakeRedis struct {
+	listener net.Listener
+	values   map[string]string
+	expires  map[string]time.Time
+
+	mu sync.Mutex
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeRedis{
+		listener: listener,
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+func (r *fakeRedis) options() *redis.Options {
+	return &redis.Options{Addr: r.listener.Addr().String(), MaxRetries: -1}
+}
+
+// ttl returns the time to live of a key, or zero if it doesn't expire.
+func (r *fakeRedis) ttl(key string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if at, ok := r.expires[key]; ok {
+		return time.Until(at)
+	}
+	return 0
+}
+
+func (r *fakeRedis) keys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var keys []string
+	for key := range r.values {
+		if r.live(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(br)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, r.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(br *bufio.Reader) ([]string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// live reports whether a key exists and hasn't expired, removing it if it
+// has. r.mu must be held.
+func (r *fakeRedis) live(key string) bool {
+	if at, ok := r.expires[key]; ok && !time.Now().Before(at) {
+		delete(r.values, key)
+		delete(r.expires, key)
+	}
+	_, ok := r.values[key]
+	return ok
+}
+
+func (r *fakeRedis) exec(args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		if !r.live(args[1]) {
+			return "$-1\r\n"
+		}
+		return bulk(r.values[args[1]])
+	case "SET":
+		return r.set(args[1:])
+	case "EXISTS":
+		n := 0
+		for _, key := range args[1:] {
+			if r.live(key) {
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if r.live(key) {
+				delete(r.values, key)
+				delete(r.expires, key)
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "SCAN":
+		// Everything is returned in one go, with a cursor of 0
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var matches []string
+		for key := range r.values {
+			if ok, _ := path.Match(pattern, key); ok && r.live(key) {
+				matches = append(matches, bulk(key))
+			}
+		}
+		return "*2\r\n" + bulk("0") + "*" + strconv.Itoa(len(matches)) + "\r\n" + strings.Join(matches, "")
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+func (r *fakeRedis) set(args []string) string {
+	key, value := args[0], args[1]
+	var expires time.Time
+	nx := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "EX", "PX":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return "-ERR value is not an integer\r\n"
+			}
+			unit := time.Second
+			if strings.ToUpper(args[i]) == "PX" {
+				unit = time.Millisecond
+			}
+			expires = time.Now().Add(time.Duration(n) * unit)
+			i++
+		case "NX":
+			nx = true
+		}
+	}
+
+	if nx && r.live(key) {
+		return "$-1\r\n"
+	}
+	r.values[key] = value
+	delete(r.expires, key)
+	if !expires.IsZero() {
+		r.expires[key] = expires
+	}
+	return "+OK\r\n"
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func TestRedisBlobStore(t *testing.T) {
+	server := newFakeRedis(t)
+	store := NewRedisBlobStore("tme", server.options(), time.Hour, context.Background())
+
+	if err := store.Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	if data, err := store.Get("b123"); data != nil || err != nil {
+		t.Errorf("Get of missing blob = %q, %v, want nil, nil", data, err)
+	}
+	if ok, err := store.Has("b123"); ok || err != nil {
+		t.Errorf("Has of missing blob = %v, %v, want false, nil", ok, err)
+	}
+
+	data := []byte("\x89PNG\r\n\x1a\n\x00binary")
+	if err := store.Put("b123", data); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got, err := store.Get("b123"); string(got) != string(data) || err != nil {
+		t.Errorf("Get = %q, %v, want %q", got, err, data)
+	}
+	if ok, err := store.Has("b123"); !ok || err != nil {
+		t.Errorf("Has = %v, %v, want true, nil", ok, err)
+	}
+
+	// Blobs are namespaced and expire
+	if keys := server.keys(); len(keys) != 1 || keys[0] != "tme:images:b123" {
+		t.Errorf("keys = %q, want [tme:images:b123]", keys)
+	}
+	if ttl := server.ttl("tme:images:b123"); ttl <= time.Minute*59 || ttl > time.Hour {
+		t.Errorf("TTL = %v, want 1h", ttl)
+	}
+}
+
+func TestRedisBlobStoreExpiration(t *testing.T) {
+	server := newFakeRedis(t)
+	store := NewRedisBlobStore("tme", server.options(), time.Millisecond*50, context.Background())
+
+	if err := store.Put("b123", []byte("data")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if data, err := store.Get("b123"); data != nil || err != nil {
+		t.Errorf("Get of expired blob = %q, %v, want nil, nil", data, err)
+	}
+}
+
+func TestRedisBlobStorePurge(t *testing.T) {
+	server := newFakeRedis(t)
+	store := NewRedisBlobStore("tme", server.options(), time.Hour, context.Background())
+	other := NewRedisSettingsRepository("tme", server.options(), context.Background())
+
+	for _, key := range []string{"b1", "b2", "f3"} {
+		if err := store.Put(key, []byte(key)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := other.Save("1", &Settings{}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	if err := store.Purge(); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	// Only images are removed
+	if keys := server.keys(); len(keys) != 1 || keys[0] != "tme:settings:user_id:1" {
+		t.Errorf("keys after Purge = %q, want [tme:settings:user_id:1]", keys)
+	}
+}
+
+func TestRedisBlobStoreUnavailable(t *testing.T) {
+	server := newFakeRedis(t)
+	options := server.options()
+	server.listener.Close()
+	store := NewRedisBlobStore("tme", options, time.Hour, context.Background())
+
+	if _, err := store.Get("b123"); err == nil {
+		t.Error("Get succeeded without a server")
+	}
+	if _, err := store.Has("b123"); err == nil {
+		t.Error("Has succeeded without a server")
+	}
+	if err := store.Put("b123", []byte("data")); err == nil {
+		t.Error("Put succeeded without a server")
+	}
+}
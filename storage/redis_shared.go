@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"time"
+)
+
+// unlockScript deletes a lock only if it is still held by the caller's token.
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RedisSharedCache stores emote metadata shared between server replicas.
+type RedisSharedCache struct {
+	namespace string
+	client    *redis.Client
+	ctx       context.Context
+}
+
+func NewRedisSharedCache(namespace string, options *redis.Options, ctx context.Context) *RedisSharedCache {
+	client := redis.NewClient(options)
+
+	return &RedisSharedCache{
+		namespace: namespace,
+		client:    client,
+		ctx:       ctx,
+	}
+}
+
+func (r *RedisSharedCache) key(name string) string {
+	return r.namespace + ":" + name
+}
+
+func (r *RedisSharedCache) GetChannel(channelID string) ([]byte, error) {
+	data, err := r.client.Get(r.ctx, r.key("emotes:channel:"+channelID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (r *RedisSharedCache) SetChannel(channelID string, data []byte, ttl time.Duration) error {
+	return r.client.Set(r.ctx, r.key("emotes:channel:"+channelID), data, ttl).Err()
+}
+
+func (r *RedisSharedCache) GetAspectRatio(key string) (float64, bool, error) {
+	ratio, err := r.client.Get(r.ctx, r.key("emotes:aspect_ratio:"+key)).Float64()
+	if err == redis.Nil {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	return ratio, true, nil
+}
+
+// SetAspectRatio stores an aspect ratio under its own key, so that ratios of
+// emotes nobody uses anymore expire instead of piling up.
+func (r *RedisSharedCache) SetAspectRatio(key string, ratio float64, ttl time.Duration) error {
+	return r.client.Set(r.ctx, r.key("emotes:aspect_ratio:"+key), ratio, ttl).Err()
+}
+
+func (r *RedisSharedCache) Lock(name string, ttl time.Duration) (func(), error) {
+	lockKey := r.key("lock:" + name)
+	token := uuid.NewString()
+
+	acquired, err := r.client.SetNX(r.ctx, lockKey, token, ttl).Result()
+	if err != nil {
+		return nil, err
+	} else if !acquired {
+		return nil, nil
+	}
+
+	return func() {
+		// Use a fresh context so the lock is released even during shutdown
+		_ = unlockScript.Run(context.Background(), r.client, []string{lockKey}, token).Err()
+	}, nil
+}
+
+func (r *RedisSharedCache) Ping() error {
+	return r.client.Ping(r.ctx).Err()
+}
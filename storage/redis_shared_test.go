@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRedisSharedCacheAspectRatio(t *testing.T) {
+	server := newFakeRedis(t)
+	cache := NewRedisSharedCache("tme", server.options(), context.Background())
+
+	if ratio, found, err := cache.GetAspectRatio("b123"); found || err != nil {
+		t.Errorf("GetAspectRatio of missing key = %v, %v, %v, want not found", ratio, found, err)
+	}
+
+	if err := cache.SetAspectRatio("b123", 2.5, time.Hour); err != nil {
+		t.Fatalf("SetAspectRatio: %v", err)
+	}
+	if err := cache.SetAspectRatio("f456", 1, time.Hour); err != nil {
+		t.Fatalf("SetAspectRatio: %v", err)
+	}
+	if ratio, found, err := cache.GetAspectRatio("b123"); ratio != 2.5 || !found || err != nil {
+		t.Errorf("GetAspectRatio = %v, %v, %v, want 2.5, true, nil", ratio, found, err)
+	}
+
+	// Each ratio is a key of its own that expires
+	for _, key := range []string{"tme:emotes:aspect_ratio:b123", "tme:emotes:aspect_ratio:f456"} {
+		if ttl := server.ttl(key); ttl <= time.Minute*59 || ttl > time.Hour {
+			t.Errorf("TTL of %q = %v, want 1h", key, ttl)
+		}
+	}
+}
+
+func TestRedisSharedCacheAspectRatioExpires(t *testing.T) {
+	server := newFakeRedis(t)
+	cache := NewRedisSharedCache("tme", server.options(), context.Background())
+
+	if err := cache.SetAspectRatio("b123", 2.5, time.Millisecond*50); err != nil {
+		t.Fatalf("SetAspectRatio: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if ratio, found, err := cache.GetAspectRatio("b123"); found || err != nil {
+		t.Errorf("GetAspectRatio of expired key = %v, %v, %v, want not found", ratio, found, err)
+	}
+}
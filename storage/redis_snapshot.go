@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisSnapshotRepository stores emote metadata snapshots in Redis.
+type RedisSnapshotRepository struct {
+	namespace string
+	client    *redis.Client
+	ctx       context.Context
+}
+
+func NewRedisSnapshotRepository(namespace string, options *redis.Options, ctx context.Context) *RedisSnapshotRepository {
+	client := redis.NewClient(options)
+
+	return &RedisSnapshotRepository{
+		namespace: namespace,
+		client:    client,
+		ctx:       ctx,
+	}
+}
+
+func (r *RedisSnapshotRepository) key(name string) string {
+	return r.namespace + ":" + name
+}
+
+func (r *RedisSnapshotRepository) LoadSnapshot() ([]byte, error) {
+	data, err := r.client.Get(r.ctx, r.key("snapshot:emotes")).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (r *RedisSnapshotRepository) SaveSnapshot(data []byte) error {
+	// Use a fresh context so that the final snapshot on shutdown can still be written
+	return r.client.Set(context.Background(), r.key("snapshot:emotes"), data, 0).Err()
+}